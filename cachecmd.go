@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/kawaz/go-zunproxy/config"
+	"github.com/kawaz/go-zunproxy/middleware"
+)
+
+const cacheUsage = `usage: zunproxy [-config FILE] cache <command> [options]
+
+commands:
+  export  キャッシュを JSON lines で書き出す（-o が .gz なら gzip 圧縮する）
+  import  export したファイルを memcached に書き込む（-i が .gz なら gzip 展開する）
+  rollback  キャッシュを過去の世代に戻して暫く固定する（Cache.Versions が必要）
+  pin     URL のレスポンスを指定した内容に固定する（バックエンドにもキャッシュにも行かなくなる）
+  pins    固定しているレスポンスの一覧を表示する
+  unpin   URL の固定を外す
+`
+
+// cacheCommand zunproxy cache サブコマンド
+func cacheCommand(cfg *config.Config, args []string) error {
+	if cfg.Cache == nil {
+		return fmt.Errorf("Cache is not configured")
+	}
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, cacheUsage)
+		return fmt.Errorf("no cache command")
+	}
+	cache := middleware.NewCacheHandler(cfg.Cache).(*middleware.CacheHandler)
+	switch args[0] {
+	case "export":
+		return cacheExport(cache, args[1:])
+	case "import":
+		return cacheImport(cache, args[1:])
+	case "rollback":
+		return cacheRollback(cache, args[1:])
+	case "pin":
+		return cachePin(cache, args[1:])
+	case "pins":
+		return cachePins(cache, args[1:])
+	case "unpin":
+		return cacheUnpin(cache, args[1:])
+	}
+	fmt.Fprint(os.Stderr, cacheUsage)
+	return fmt.Errorf("unknown cache command: %v", args[0])
+}
+
+func cacheExport(cache *middleware.CacheHandler, args []string) error {
+	flags := flag.NewFlagSet("cache export", flag.ExitOnError)
+	urls := flags.String("urls", "", "URL list file (one \"[METHOD] URL\" per line)")
+	dumps := flags.String("dumps", "", "DumpDir to read requests from dump json files")
+	index := flags.String("index", "", "KeyIndexFile written by CacheHandler")
+	out := flags.String("o", "-", "output file")
+	flags.Parse(args)
+
+	keySources, err := exportKeySources(cache, *urls, *dumps, *index)
+	if err != nil {
+		return err
+	}
+	if len(keySources) == 0 {
+		return fmt.Errorf("no keys to export: specify -urls, -dumps or -index")
+	}
+	w, err := createOutput(*out)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	exported := 0
+	for _, ks := range keySources {
+		e, err := cache.ExportEntry(ks)
+		if err != nil {
+			log.Printf("could not export %v: %v", ks, err)
+			continue
+		}
+		if e == nil {
+			continue
+		}
+		if err := enc.Encode(e); err != nil {
+			w.Close()
+			return fmt.Errorf("could not write %v: %v", *out, err)
+		}
+		exported++
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("could not write %v: %v", *out, err)
+	}
+	log.Printf("exported %v/%v entries", exported, len(keySources))
+	return nil
+}
+
+func cacheImport(cache *middleware.CacheHandler, args []string) error {
+	flags := flag.NewFlagSet("cache import", flag.ExitOnError)
+	in := flags.String("i", "-", "input file")
+	flags.Parse(args)
+
+	r, err := openInput(*in)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	dec := json.NewDecoder(r)
+	imported, skipped := 0, 0
+	for {
+		var e middleware.CacheExportEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("could not read %v: %v", *in, err)
+		}
+		ok, err := cache.ImportEntry(&e)
+		if err != nil {
+			log.Print(err)
+		}
+		if ok {
+			imported++
+		} else {
+			skipped++
+		}
+	}
+	log.Printf("imported %v entries, skipped %v entries", imported, skipped)
+	return nil
+}
+
+func cacheRollback(cache *middleware.CacheHandler, args []string) error {
+	flags := flag.NewFlagSet("cache rollback", flag.ExitOnError)
+	u := flags.String("url", "", "URL to rollback")
+	tag := flags.String("tag", "", "rollback only entries tagged with this name (Cache.Versions.Tags)")
+	before := flags.String("before", "", "rollback to the version used before this time (RFC3339). default is the previous version")
+	pin := flags.Duration("pin", time.Hour, "do not refresh rolled back entries for this duration")
+	urls := flags.String("urls", "", "URL list file (one \"[METHOD] URL\" per line)")
+	dumps := flags.String("dumps", "", "DumpDir to read requests from dump json files")
+	index := flags.String("index", "", "KeyIndexFile written by CacheHandler")
+	flags.Parse(args)
+
+	var beforeTime time.Time
+	if *before != "" {
+		t, err := time.Parse(time.RFC3339, *before)
+		if err != nil {
+			return fmt.Errorf("invalid -before: %v", err)
+		}
+		beforeTime = t
+	}
+	var keySources []string
+	if *u != "" {
+		r, err := http.NewRequest(http.MethodGet, *u, nil)
+		if err != nil {
+			return fmt.Errorf("invalid -url: %v", err)
+		}
+		keySources = append(keySources, cache.KeySource(r))
+	}
+	ks, err := exportKeySources(cache, *urls, *dumps, *index)
+	if err != nil {
+		return err
+	}
+	keySources = append(keySources, ks...)
+	if len(keySources) == 0 {
+		return fmt.Errorf("no keys to rollback: specify -url, -urls, -dumps or -index")
+	}
+	rolledBack := 0
+	for _, ks := range keySources {
+		ok, err := cache.Rollback(ks, *tag, beforeTime, *pin)
+		if err != nil {
+			log.Printf("could not rollback %v: %v", ks, err)
+			continue
+		}
+		if ok {
+			rolledBack++
+		}
+	}
+	log.Printf("rolled back %v/%v entries", rolledBack, len(keySources))
+	return nil
+}
+
+// headerFlags -header を複数回指定できるようにする
+type headerFlags []string
+
+func (h *headerFlags) String() string     { return strings.Join(*h, ", ") }
+func (h *headerFlags) Set(v string) error { *h = append(*h, v); return nil }
+
+func cachePin(cache *middleware.CacheHandler, args []string) error {
+	flags := flag.NewFlagSet("cache pin", flag.ExitOnError)
+	u := flags.String("url", "", "URL to pin")
+	code := flags.Int("code", http.StatusOK, "status code of the pinned response")
+	body := flags.String("body", "", "file of the pinned response body (- for stdin)")
+	var headers headerFlags
+	flags.Var(&headers, "header", "header of the pinned response \"Name: value\" (repeatable)")
+	until := flags.String("until", "", "unpin at this time (RFC3339). default is until unpinned")
+	dur := flags.Duration("for", 0, "unpin after this duration")
+	flags.Parse(args)
+
+	if *u == "" {
+		return fmt.Errorf("-url is required")
+	}
+	r, err := http.NewRequest(http.MethodGet, *u, nil)
+	if err != nil {
+		return fmt.Errorf("invalid -url: %v", err)
+	}
+	header, err := middleware.ParsePinHeaders(headers)
+	if err != nil {
+		return err
+	}
+	var b []byte
+	if *body != "" {
+		in, err := openInput(*body)
+		if err != nil {
+			return err
+		}
+		b, err = io.ReadAll(in)
+		in.Close()
+		if err != nil {
+			return fmt.Errorf("could not read %v: %v", *body, err)
+		}
+	}
+	var untilTime time.Time
+	if *until != "" {
+		if untilTime, err = time.Parse(time.RFC3339, *until); err != nil {
+			return fmt.Errorf("invalid -until: %v", err)
+		}
+	}
+	if *dur > 0 {
+		untilTime = time.Now().Add(*dur)
+	}
+	if err := cache.Pin(r, middleware.NewPinnedResponse(*code, header, b), untilTime); err != nil {
+		return err
+	}
+	log.Printf("pinned %v", cache.KeySource(r))
+	return nil
+}
+
+func cachePins(cache *middleware.CacheHandler, args []string) error {
+	flags := flag.NewFlagSet("cache pins", flag.ExitOnError)
+	flags.Parse(args)
+
+	pins, err := cache.Pins()
+	if err != nil {
+		return err
+	}
+	for _, p := range pins {
+		until := "-"
+		if !p.Until.IsZero() {
+			until = p.Until.Format(time.RFC3339)
+		}
+		fmt.Printf("%v\t%v\t%v\t%v\n", p.Response.Code, p.Created.Format(time.RFC3339), until, p.KeySource)
+	}
+	return nil
+}
+
+func cacheUnpin(cache *middleware.CacheHandler, args []string) error {
+	flags := flag.NewFlagSet("cache unpin", flag.ExitOnError)
+	u := flags.String("url", "", "URL to unpin")
+	flags.Parse(args)
+
+	if *u == "" {
+		return fmt.Errorf("-url is required")
+	}
+	r, err := http.NewRequest(http.MethodGet, *u, nil)
+	if err != nil {
+		return fmt.Errorf("invalid -url: %v", err)
+	}
+	ok, err := cache.Unpin(r)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("not pinned: %v", cache.KeySource(r))
+	}
+	log.Printf("unpinned %v", cache.KeySource(r))
+	return nil
+}
+
+// exportKeySources エクスポートするキャッシュのキー元を集める（memcached はキーを列挙できないので外から与える）
+func exportKeySources(cache *middleware.CacheHandler, urls, dumps, index string) ([]string, error) {
+	var keySources []string
+	if index != "" {
+		f, err := os.Open(index)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		ks, err := middleware.ReadKeyIndex(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %v: %v", index, err)
+		}
+		keySources = append(keySources, ks...)
+	}
+	if urls != "" {
+		f, err := os.Open(urls)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			method, u := http.MethodGet, line
+			if fields := strings.Fields(line); len(fields) == 2 {
+				method, u = fields[0], fields[1]
+			}
+			r, err := http.NewRequest(method, u, nil)
+			if err != nil {
+				log.Printf("skip %q: %v", line, err)
+				continue
+			}
+			keySources = append(keySources, cache.KeySource(r))
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("could not read %v: %v", urls, err)
+		}
+	}
+	if dumps != "" {
+		err := filepath.WalkDir(dumps, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !strings.HasSuffix(path, ".json") {
+				return err
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r, err := middleware.LoadDumpRequest(f)
+			if err != nil {
+				log.Printf("skip %v: %v", path, err)
+				return nil
+			}
+			keySources = append(keySources, cache.KeySource(r))
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not read %v: %v", dumps, err)
+		}
+	}
+	return middleware.ReadKeyIndex(strings.NewReader(strings.Join(keySources, "\n")))
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+type multiCloser struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (mc multiCloser) Close() error {
+	var err error
+	for _, c := range mc.closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// createOutput "-" なら標準出力、.gz なら gzip 圧縮して書き込む
+func createOutput(file string) (io.WriteCloser, error) {
+	if file == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(file, ".gz") {
+		gz := gzip.NewWriter(f)
+		return multiCloser{gz, []io.Closer{gz, f}}, nil
+	}
+	return f, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// openInput "-" なら標準入力、.gz なら gzip 展開して読み込む
+func openInput(file string) (io.ReadCloser, error) {
+	if file == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(file, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return readCloser{gz, f}, nil
+	}
+	return f, nil
+}
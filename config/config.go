@@ -22,7 +22,19 @@ type Config struct {
 	Backend string
 	DumpDir string
 	Bundler bool
-	Cache   *middleware.CacheConfig
+	// Bundler の設定（nil ならデフォルト）
+	BundlerConfig *middleware.RequestBundlerConfig
+	Cache         *middleware.CacheConfig
+	// Upgrade（WebSocket など）したコネクションの制限（nil なら制限しない）
+	Upgrade *middleware.UpgradeConfig
+	// 壊れたレスポンスを検査するルール（nil ならデフォルトの HTML の閉じタグのチェック）
+	Guard *middleware.BrokenRewriteGuardConfig
+	// AdminPort 管理用 API を待ち受けるポート（0 なら起動しない）
+	AdminPort int
+	// AdminAddr 管理用 API を待ち受けるアドレス（デフォルトは 127.0.0.1。ループバック以外では AdminToken が必須）
+	AdminAddr string
+	// AdminToken 管理用 API に Authorization: Bearer で要求するトークン
+	AdminToken string
 }
 
 func Load(files ...string) (*Config, error) {
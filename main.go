@@ -5,12 +5,14 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	_ "net/http/pprof"
 	"net/url"
 	"os"
 	"path"
+	"strconv"
 
 	"github.com/k0kubun/pp"
 	"github.com/kawaz/go-zunproxy/config"
@@ -49,27 +51,42 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	// サブコマンド
+	if flag.Arg(0) == "cache" {
+		if err := cacheCommand(cfg, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
 	pp.Println(build)
 	pp.Println(cfg)
 
 	// ミドルウェア
 	var middlewares []middleware.Middleware
+	// 管理用 API
+	admin := http.NewServeMux()
+	// Upgrade（WebSocket など）は他のミドルウェアを素通りするので切断の制限だけ掛ける
+	if cfg.Upgrade != nil {
+		middlewares = append(middlewares, middleware.NewUpgradeLimiter(cfg.Upgrade))
+	}
 	if cfg.DumpDir != "" {
 		dump := middleware.NewDumpHandler(cfg.DumpDir)
 		middlewares = append(middlewares, dump)
 	}
 	// 同じリクエストの同時処理を1つに制限して結果を共有する
 	if cfg.Bundler {
-		bundler := middleware.NewRequestBundlerDefault()
+		bundler := middleware.NewRequestBundlerWithConfig(cfg.BundlerConfig)
 		middlewares = append(middlewares, bundler)
+		admin.Handle("/bundler/", middleware.NewBundlerAdminHandler(bundler.(middleware.RequestBundler)))
 	}
 	// レスポンスキャッシュ
 	if cfg.Cache != nil {
 		cache := middleware.NewCacheHandler(cfg.Cache)
 		middlewares = append(middlewares, cache)
+		admin.Handle("/cache/", middleware.NewCacheAdminHandler(cache.(*middleware.CacheHandler)))
 	}
 	// 壊れたレスポンスをエラーにする奴
-	middlewares = append(middlewares, middleware.NewBrokenRewriteGuard())
+	middlewares = append(middlewares, middleware.NewBrokenRewriteGuardWithConfig(cfg.Guard))
 	// ハンドラ
 	backendUrl, err := url.Parse(cfg.Backend)
 	if err != nil {
@@ -78,9 +95,28 @@ func main() {
 	backendProxy := httputil.NewSingleHostReverseProxy(backendUrl)
 
 	// 起動
+	if cfg.AdminPort != 0 {
+		// expvar(/debug/vars) と pprof は DefaultServeMux に登録されるので管理用のポートでだけ公開する
+		admin.Handle("/debug/", http.DefaultServeMux)
+		adminHost := cfg.AdminAddr
+		if adminHost == "" {
+			adminHost = "127.0.0.1"
+		}
+		var adminHandler http.Handler = admin
+		if cfg.AdminToken != "" {
+			adminHandler = middleware.RequireAdminToken(cfg.AdminToken, admin)
+		} else if ip := net.ParseIP(adminHost); adminHost != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			// 認証なしの管理用 API を外に公開しない
+			log.Fatalf("AdminToken is required to listen admin API on %v", adminHost)
+		}
+		adminAddr := net.JoinHostPort(adminHost, strconv.Itoa(cfg.AdminPort))
+		go func() {
+			log.Printf("zunproxy admin start at %v", adminAddr)
+			log.Fatal(http.ListenAndServe(adminAddr, adminHandler))
+		}()
+	}
 	handler := middleware.MultipleHandler(backendProxy, middlewares...)
-	http.Handle("/", handler)
 	addr := fmt.Sprintf(":%d", cfg.Port)
 	log.Printf("zunproxy start at %v -> %v", addr, cfg.Backend)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	log.Fatal(http.ListenAndServe(addr, handler))
 }
@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// NewBundlerAdminHandler RequestBundler の管理用 API
+//
+//	GET /bundler/waiters    実行中のリクエスト毎の待っているクライアント数（多い順）
+func NewBundlerAdminHandler(rb RequestBundler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bundler/waiters", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			adminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+			return
+		}
+		adminJSON(w, rb.Waiters())
+	})
+	return mux
+}
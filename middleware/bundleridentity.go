@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/textproto"
+
+	"github.com/kawaz/go-requestid"
+)
+
+// newBundlerIDGenerator config から同じリクエストかを判定する RequestIDGenerator を作る
+// （requestid の *Accept や PathRestrict はマッチしたものを除外してしまうので、クリーナーを直接組み立てる）
+func newBundlerIDGenerator(config *RequestBundlerConfig) *requestid.RequestIDGenerator {
+	gen := &requestid.RequestIDGenerator{HashFunc: sha256.New}
+	methods := config.Methods
+	if methods == nil {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	}
+	gen.MethodRestrict(methods...)
+	if len(config.Paths) != 0 {
+		match := wildCardMatcher(config.Paths)
+		gen.AddRequestCleaner(func(r *requestid.Request) *requestid.Request {
+			r.Expected = !match(r.Path)
+			return r
+		})
+	}
+	if len(config.ExceptPaths) != 0 {
+		gen.PathExcept(wildCards(config.ExceptPaths)...)
+	}
+	// ヘッダは指定されたときだけ絞り込む（nil なら全てのヘッダで区別する）
+	acceptHeader := func(string) bool { return true }
+	if config.Headers != nil {
+		canonical := make([]string, len(config.Headers))
+		for i, h := range config.Headers {
+			canonical[i] = textproto.CanonicalMIMEHeaderKey(h)
+		}
+		acceptHeader = wildCardMatcher(canonical)
+	}
+	gen.AddRequestCleaner(func(r *requestid.Request) *requestid.Request {
+		r.HeaderEnabled = true
+		for k := range r.Header {
+			// Cookie ヘッダはクッキー単位で区別するので下で扱う
+			if k == "Cookie" || !acceptHeader(k) {
+				r.Header.Del(k)
+			}
+		}
+		return r
+	})
+	// Accept-Encoding は gzip を受け付けるかどうかだけで区別する
+	if acceptHeader("Accept-Encoding") {
+		gen.AddRequestCleaner(requestid.NormarizeAcceptEncodingGzip())
+	}
+	acceptQuery := func(string) bool { return true }
+	if config.QueryAccept != nil {
+		acceptQuery = wildCardMatcher(config.QueryAccept)
+	}
+	queryDrop := config.QueryDrop
+	if queryDrop == nil {
+		queryDrop = []string{"utm_*", "gclid", "fbclid"}
+	}
+	dropQuery := wildCardMatcher(queryDrop)
+	gen.AddRequestCleaner(func(r *requestid.Request) *requestid.Request {
+		r.QueryEnabled = true
+		for k := range r.Query {
+			if !acceptQuery(k) || dropQuery(k) {
+				r.Query.Del(k)
+			}
+		}
+		return r
+	})
+	// クッキーも指定されたときだけ絞り込む（nil なら全てのクッキーで区別する）
+	acceptCookie := func(string) bool { return true }
+	if config.Cookies != nil {
+		acceptCookie = wildCardMatcher(config.Cookies)
+	}
+	gen.AddRequestCleaner(func(r *requestid.Request) *requestid.Request {
+		r.CookieEnabled = true
+		for k := range r.Cookies {
+			if !acceptCookie(k) {
+				r.Cookies.Del(k)
+			}
+		}
+		return r
+	})
+	return gen
+}
+
+func wildCards(patterns []string) []requestid.WildCard {
+	ws := make([]requestid.WildCard, len(patterns))
+	for i, p := range patterns {
+		ws[i] = requestid.WildCard(p)
+	}
+	return ws
+}
+
+// wildCardMatcher patterns のどれかにマッチするか
+func wildCardMatcher(patterns []string) requestid.StringMatcher {
+	return requestid.WildCardSlice(wildCards(patterns)).AnyMatcher()
+}
+
+// skip 設定で纏めないことにしているリクエストか
+// ボディは ID に含めないので、GET, HEAD, OPTIONS 以外のボディがあるリクエストは SkipBody でなくても纏めない
+func (dp *requestBundler) skip(r *http.Request) bool {
+	// ContentLength が -1（不明）のものもボディありとみなす
+	if r.ContentLength != 0 {
+		if dp.skipBody {
+			return true
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			return true
+		}
+	}
+	if dp.skipAuthorization && r.Header.Get("Authorization") != "" {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewBundlerIDGenerator(t *testing.T) {
+	req := func(method, url string, header ...string) *http.Request {
+		r := httptest.NewRequest(method, url, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Add(header[i], header[i+1])
+		}
+		return r
+	}
+	tests := []struct {
+		name   string
+		config RequestBundlerConfig
+		a, b   *http.Request
+		// 同じ ID になるべきか（ok=false のものは ID が取れないこと）
+		same bool
+		ok   bool
+	}{
+		{"default same", RequestBundlerConfig{}, req("GET", "/a?x=1&utm_source=a"), req("GET", "/a?x=1&utm_source=b"), true, true},
+		{"default query", RequestBundlerConfig{}, req("GET", "/a?x=1"), req("GET", "/a?x=2"), false, true},
+		{"default gzip", RequestBundlerConfig{}, req("GET", "/a", "Accept-Encoding", "gzip, br"), req("GET", "/a", "Accept-Encoding", "gzip"), true, true},
+		{"default header", RequestBundlerConfig{}, req("GET", "/a", "User-Agent", "a"), req("GET", "/a", "User-Agent", "b"), false, true},
+		{"default authorization", RequestBundlerConfig{}, req("GET", "/a", "Authorization", "a"), req("GET", "/a", "Authorization", "b"), false, true},
+		{"default post", RequestBundlerConfig{}, req("POST", "/a"), req("POST", "/a"), false, false},
+		{"methods", RequestBundlerConfig{Methods: []string{"GET"}}, req("HEAD", "/a"), req("HEAD", "/a"), false, false},
+		{"paths", RequestBundlerConfig{Paths: []string{"/api/*"}}, req("GET", "/a"), req("GET", "/a"), false, false},
+		{"except paths", RequestBundlerConfig{ExceptPaths: []string{"/a"}}, req("GET", "/a"), req("GET", "/a"), false, false},
+		{"headers", RequestBundlerConfig{Headers: []string{"X-Device"}}, req("GET", "/a", "X-Device", "sp"), req("GET", "/a", "X-Device", "pc"), false, true},
+		{"headers ignore others", RequestBundlerConfig{Headers: []string{"X-Device"}}, req("GET", "/a", "Authorization", "a"), req("GET", "/a", "Authorization", "b"), true, true},
+		{"query accept", RequestBundlerConfig{QueryAccept: []string{"id"}}, req("GET", "/a?id=1&x=1"), req("GET", "/a?id=1&x=2"), true, true},
+		{"query drop", RequestBundlerConfig{QueryDrop: []string{"x"}}, req("GET", "/a?x=1"), req("GET", "/a?x=2"), true, true},
+		{"default cookies", RequestBundlerConfig{}, req("GET", "/a", "Cookie", "s=1"), req("GET", "/a", "Cookie", "s=2"), false, true},
+		{"headers keep cookies", RequestBundlerConfig{Headers: []string{"X-Device"}}, req("GET", "/a", "Cookie", "s=1"), req("GET", "/a", "Cookie", "s=2"), false, true},
+		{"headers narrow", RequestBundlerConfig{Headers: []string{"X-Device"}}, req("GET", "/a", "User-Agent", "a"), req("GET", "/a", "User-Agent", "b"), true, true},
+		{"cookies", RequestBundlerConfig{Cookies: []string{"s"}}, req("GET", "/a", "Cookie", "s=1; t=1"), req("GET", "/a", "Cookie", "s=2; t=1"), false, true},
+		{"cookies ignore others", RequestBundlerConfig{Cookies: []string{"s"}}, req("GET", "/a", "Cookie", "s=1; t=1"), req("GET", "/a", "Cookie", "s=1; t=2"), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gen := newBundlerIDGenerator(&tt.config)
+			idA, okA := gen.GenerateID(tt.a)
+			idB, okB := gen.GenerateID(tt.b)
+			if okA != tt.ok || okB != tt.ok {
+				t.Fatalf("ok = %v, %v, want %v", okA, okB, tt.ok)
+			}
+			if tt.ok && (idA == idB) != tt.same {
+				t.Errorf("same = %v, want %v", idA == idB, tt.same)
+			}
+		})
+	}
+}
+
+func TestRequestBundler_Skip(t *testing.T) {
+	dp := newRequestBundler(&RequestBundlerConfig{SkipBody: true, SkipAuthorization: true}, nil)
+	if dp.skip(httptest.NewRequest("GET", "/", nil)) {
+		t.Errorf("plain request is skipped")
+	}
+	if !dp.skip(httptest.NewRequest("GET", "/", strings.NewReader("body"))) {
+		t.Errorf("request with body is not skipped")
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer x")
+	if !dp.skip(r) {
+		t.Errorf("request with Authorization is not skipped")
+	}
+	if newRequestBundler(&RequestBundlerConfig{}, nil).skip(r) {
+		t.Errorf("skipped without SkipAuthorization")
+	}
+	// ボディは ID に含めないので GET, HEAD, OPTIONS 以外のボディがあるリクエストは常に纏めない
+	dp = newRequestBundler(&RequestBundlerConfig{Methods: []string{"GET", "POST", "PUT"}}, nil)
+	if dp.skip(httptest.NewRequest("GET", "/", strings.NewReader("body"))) {
+		t.Errorf("GET with body is skipped without SkipBody")
+	}
+	if dp.skip(httptest.NewRequest("POST", "/", nil)) {
+		t.Errorf("POST without body is skipped")
+	}
+	for _, method := range []string{"POST", "PUT"} {
+		if !dp.skip(httptest.NewRequest(method, "/", strings.NewReader("body"))) {
+			t.Errorf("%v with body is not skipped", method)
+		}
+	}
+}
+
+func TestRequestBundler_PostBody(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		io.Copy(w, r.Body)
+	})
+	h := NewRequestBundlerWithConfig(&RequestBundlerConfig{Methods: []string{"POST"}}).Handle(app)
+	bodies := []string{"a", "b"}
+	res := make([]chan string, len(bodies))
+	for i, body := range bodies {
+		res[i] = make(chan string, 1)
+		go func(body string, res chan string) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+			res <- rec.Body.String()
+		}(body, res[i])
+	}
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&hits) != 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("POST with a different body is merged (hits = %v)", atomic.LoadInt32(&hits))
+		}
+	}
+	close(release)
+	// 違うボディの POST が他人のレスポンスを受け取らない
+	for i, body := range bodies {
+		if got := <-res[i]; got != body {
+			t.Errorf("response to %q = %q", body, got)
+		}
+	}
+}
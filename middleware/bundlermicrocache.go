@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MicroCacheConfig RequestBundler で完了したレスポンスを暫く残しておく設定
+// キャッシュできないが共有はできるレスポンスにアクセスが殺到した時に、完了直後に来た同じリクエストもバックエンドに流さずに済ませる
+type MicroCacheConfig struct {
+	// 完了したレスポンスを残しておく期間（500ms など）
+	Window time.Duration
+	// 残しておくレスポンスボディの最大サイズ（デフォルトは 1MB）
+	MaxBytes int
+	// 残しておくレスポンスボディの合計の最大サイズ。超える分は残さない（デフォルトは 64MB）
+	TotalBytes int
+}
+
+type microCache struct {
+	window     time.Duration
+	maxBytes   int
+	totalBytes int
+	// 残しているレスポンスボディの合計サイズ（requestBundler.dwM で保護する）
+	used int
+}
+
+func newMicroCache(config *MicroCacheConfig) *microCache {
+	mc := &microCache{
+		window:     config.Window,
+		maxBytes:   config.MaxBytes,
+		totalBytes: config.TotalBytes,
+	}
+	if mc.maxBytes <= 0 {
+		mc.maxBytes = 1 << 20
+	}
+	if mc.totalBytes <= 0 {
+		mc.totalBytes = 64 << 20
+	}
+	return mc
+}
+
+// keep 完了した dw を残すか決めて、残すならサイズを確保する（dp.dwM をロックして呼ぶ）
+func (mc *microCache) keep(dw *DuplicateWriter) bool {
+	if mc.window <= 0 || dw.ctx.Err() != nil {
+		// タイムアウトやキャンセルで途切れたレスポンスは残さない
+		return false
+	}
+	if dw.dp.dw[dw.reqID] != dw || dw.container.isTooLarge() {
+		// 全体を持っていないレスポンスは後から来たリクエストに返せない
+		return false
+	}
+	if dw.container.isAborted() {
+		// panic などで途中で終わったレスポンスは残さない
+		return false
+	}
+	statusCode, header := dw.container.response()
+	if !microCacheable(statusCode, header) {
+		return false
+	}
+	size := dw.container.size()
+	if cl := header.Get("Content-Length"); cl != "" && cl != strconv.Itoa(size) {
+		// 宣言された長さに足りないレスポンスは途中で切れている
+		return false
+	}
+	if mc.maxBytes < size || mc.totalBytes < mc.used+size {
+		return false
+	}
+	mc.used += size
+	return true
+}
+
+// microCacheable 後から来た別のクライアントに返してよいレスポンスか
+// 共有キャッシュに残すべきでないもの、クライアント毎の Set-Cookie を含むもの、一時的なエラーは残さない
+func microCacheable(statusCode int, header http.Header) bool {
+	if statusCode >= 500 {
+		return false
+	}
+	if _, ok := header["Set-Cookie"]; ok {
+		return false
+	}
+	return !hasCacheControlDirective(header, "no-store", "private")
+}
+
+// expire Window が過ぎたら dw の受付を終了させてサイズを返す
+func (mc *microCache) expire(dw *DuplicateWriter) {
+	time.AfterFunc(mc.window, func() {
+		dw.dp.dwM.Lock()
+		defer dw.dp.dwM.Unlock()
+		dw.dp.unregister(dw)
+		mc.used -= dw.container.size()
+	})
+}
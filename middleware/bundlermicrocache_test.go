@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRequestBundler_MicroCache(t *testing.T) {
+	var hits int32
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		w.Header().Set("X-Hit", strings.Repeat("x", int(n)))
+		w.Write([]byte(r.URL.Query().Get("body")))
+	})
+	h := NewRequestBundlerWithConfig(&RequestBundlerConfig{
+		MicroCache: &MicroCacheConfig{Window: 50 * time.Millisecond, MaxBytes: 10, TotalBytes: 14},
+	}).Handle(app)
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		return rec
+	}
+
+	first := get("/?body=hello")
+	second := get("/?body=hello")
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Errorf("hits within window = %v, want 1", got)
+	}
+	if second.Body.String() != "hello" || second.Header().Get("X-Hit") != first.Header().Get("X-Hit") {
+		t.Errorf("response within window = %q %v", second.Body.String(), second.Header())
+	}
+	time.Sleep(80 * time.Millisecond)
+	get("/?body=hello")
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Errorf("hits after window = %v, want 2", got)
+	}
+
+	// MaxBytes を超えるものは残さない
+	get("/?body=0123456789a")
+	get("/?body=0123456789a")
+	if got := atomic.LoadInt32(&hits); got != 4 {
+		t.Errorf("hits for large body = %v, want 4", got)
+	}
+
+	// TotalBytes を超える分は残さない（/?body=hello が 5 バイト残っている）
+	get("/?body=0123456789")
+	get("/?body=0123456789")
+	if got := atomic.LoadInt32(&hits); got != 6 {
+		t.Errorf("hits over TotalBytes = %v, want 6", got)
+	}
+}
+
+func TestRequestBundler_MicroCacheSkip(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header []string
+	}{
+		{"no-store", http.StatusOK, []string{"Cache-Control", "max-age=60, No-Store"}},
+		{"private", http.StatusOK, []string{"Cache-Control", "private"}},
+		{"private field", http.StatusOK, []string{"Cache-Control", `private="X-User"`}},
+		{"set-cookie", http.StatusOK, []string{"Set-Cookie", "s=1"}},
+		{"5xx", http.StatusBadGateway, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits int32
+			app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&hits, 1)
+				for i := 0; i+1 < len(tt.header); i += 2 {
+					w.Header().Add(tt.header[i], tt.header[i+1])
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte("hello"))
+			})
+			h := NewRequestBundlerWithConfig(&RequestBundlerConfig{
+				MicroCache: &MicroCacheConfig{Window: time.Minute},
+			}).Handle(app)
+			for i := 0; i < 2; i++ {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+				if rec.Code != tt.status {
+					t.Errorf("status = %v, want %v", rec.Code, tt.status)
+				}
+			}
+			if got := atomic.LoadInt32(&hits); got != 2 {
+				t.Errorf("hits = %v, want 2", got)
+			}
+		})
+	}
+}
+
+func TestRequestBundler_MicroCacheIncomplete(t *testing.T) {
+	tests := []struct {
+		name string
+		app  func(w http.ResponseWriter)
+	}{
+		{"aborted", func(w http.ResponseWriter) {
+			w.Write([]byte("hello"))
+			panic(http.ErrAbortHandler)
+		}},
+		{"short of Content-Length", func(w http.ResponseWriter) {
+			w.Header().Set("Content-Length", "10")
+			w.Write([]byte("hello"))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits int32
+			app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&hits, 1)
+				tt.app(w)
+			})
+			h := NewRequestBundlerWithConfig(&RequestBundlerConfig{
+				MicroCache: &MicroCacheConfig{Window: time.Minute},
+			}).Handle(app)
+			for i := 0; i < 2; i++ {
+				func() {
+					// 中断されたレスポンスは http.ErrAbortHandler で接続ごと切られる
+					defer func() { recover() }()
+					h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+				}()
+			}
+			if got := atomic.LoadInt32(&hits); got != 2 {
+				t.Errorf("hits = %v, want 2", got)
+			}
+		})
+	}
+}
+
+func TestMicroCacheable(t *testing.T) {
+	tests := []struct {
+		status int
+		header http.Header
+		want   bool
+	}{
+		{http.StatusOK, http.Header{}, true},
+		{http.StatusNotFound, http.Header{}, true},
+		{http.StatusOK, http.Header{"Cache-Control": {"public, max-age=1"}}, true},
+		{http.StatusOK, http.Header{"Cache-Control": {"no-cache"}}, true},
+		{http.StatusOK, http.Header{"Cache-Control": {"public", "no-store"}}, false},
+		{http.StatusOK, http.Header{"Cache-Control": {"private"}}, false},
+		{http.StatusOK, http.Header{"Set-Cookie": {"s=1"}}, false},
+		{http.StatusInternalServerError, http.Header{}, false},
+		{http.StatusServiceUnavailable, http.Header{}, false},
+	}
+	for _, tt := range tests {
+		if got := microCacheable(tt.status, tt.header); got != tt.want {
+			t.Errorf("microCacheable(%v, %v) = %v, want %v", tt.status, tt.header, got, tt.want)
+		}
+	}
+}
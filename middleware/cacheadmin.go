@@ -0,0 +1,225 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// NewCacheAdminHandler CacheHandler の管理用 API
+//
+//	GET    /cache/pins                         固定レスポンスの一覧
+//	PUT    /cache/pins?url=URL&code=503        リクエストボディを url のレスポンスとして固定する
+//	                                           Content-Type はリクエストのものを使い、他のヘッダは header=Name:value で指定する
+//	                                           until=RFC3339 か for=1h を指定するとその時刻で固定を外す
+//	                                           ボディは BytesLimit まで。GET で固定して HEAD にも同じレスポンスを返す
+//	DELETE /cache/pins?url=URL                 固定を外す
+//	POST   /cache/rollback?url=URL&pin=1h      過去の世代に戻す（before=RFC3339 でその時刻に使われていた世代）
+//	GET    /cache/shadow                       Shadow の設定と本番のヒット率などの比較
+func NewCacheAdminHandler(cache *CacheHandler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cache/pins", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			pins, err := cache.Pins()
+			if err != nil {
+				adminError(w, http.StatusInternalServerError, err)
+				return
+			}
+			adminJSON(w, pins)
+		case http.MethodPut:
+			target, err := adminTarget(r)
+			if err != nil {
+				adminError(w, http.StatusBadRequest, err)
+				return
+			}
+			// 固定するボディもキャッシュと同じく BytesLimit までにする
+			r.Body = http.MaxBytesReader(w, r.Body, int64(cache.config.BytesLimit))
+			cr, until, err := adminPinResponse(r)
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				adminError(w, http.StatusRequestEntityTooLarge, err)
+				return
+			}
+			if err != nil {
+				adminError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := cache.Pin(target, cr, until); err != nil {
+				adminError(w, http.StatusInternalServerError, err)
+				return
+			}
+			adminJSON(w, map[string]interface{}{"Pinned": cache.KeySource(target)})
+		case http.MethodDelete:
+			target, err := adminTarget(r)
+			if err != nil {
+				adminError(w, http.StatusBadRequest, err)
+				return
+			}
+			ok, err := cache.Unpin(target)
+			if err != nil {
+				adminError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if !ok {
+				adminError(w, http.StatusNotFound, fmt.Errorf("not pinned: %v", cache.KeySource(target)))
+				return
+			}
+			adminJSON(w, map[string]interface{}{"Unpinned": cache.KeySource(target)})
+		default:
+			adminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		}
+	})
+	mux.HandleFunc("/cache/rollback", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			adminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+			return
+		}
+		target, err := adminTarget(r)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, err)
+			return
+		}
+		q := r.URL.Query()
+		var before time.Time
+		if s := q.Get("before"); s != "" {
+			if before, err = time.Parse(time.RFC3339, s); err != nil {
+				adminError(w, http.StatusBadRequest, fmt.Errorf("invalid before: %v", err))
+				return
+			}
+		}
+		pin := time.Hour
+		if s := q.Get("pin"); s != "" {
+			if pin, err = time.ParseDuration(s); err != nil {
+				adminError(w, http.StatusBadRequest, fmt.Errorf("invalid pin: %v", err))
+				return
+			}
+		}
+		ok, err := cache.Rollback(cache.KeySource(target), q.Get("tag"), before, pin)
+		if err != nil {
+			adminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		adminJSON(w, map[string]interface{}{"RolledBack": ok})
+	})
+	mux.HandleFunc("/cache/shadow", func(w http.ResponseWriter, r *http.Request) {
+		report := cache.ShadowReport()
+		if report == nil {
+			adminError(w, http.StatusNotFound, fmt.Errorf("Shadow is not configured"))
+			return
+		}
+		adminJSON(w, report)
+	})
+	return mux
+}
+
+// adminTarget url パラメータから操作対象のリクエストを作る
+func adminTarget(r *http.Request) (*http.Request, error) {
+	u := r.URL.Query().Get("url")
+	if u == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+	target, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %v", err)
+	}
+	return target, nil
+}
+
+// adminPinResponse PUT /cache/pins のリクエストから固定するレスポンスを作る
+func adminPinResponse(r *http.Request) (*CachedResponse, time.Time, error) {
+	q := r.URL.Query()
+	code := http.StatusOK
+	if s := q.Get("code"); s != "" {
+		c, err := strconv.Atoi(s)
+		if err != nil || c < 100 || 599 < c {
+			return nil, time.Time{}, fmt.Errorf("invalid code: %v", s)
+		}
+		code = c
+	}
+	header, err := ParsePinHeaders(q["header"])
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" && header.Get("Content-Type") == "" {
+		header.Set("Content-Type", ct)
+	}
+	var until time.Time
+	if s := q.Get("until"); s != "" {
+		if until, err = time.Parse(time.RFC3339, s); err != nil {
+			return nil, time.Time{}, fmt.Errorf("invalid until: %v", err)
+		}
+	}
+	if s := q.Get("for"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("invalid for: %v", err)
+		}
+		until = time.Now().Add(d)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("could not read body: %w", err)
+	}
+	return NewPinnedResponse(code, header, body), until, nil
+}
+
+// NewPinnedResponse 固定するレスポンスを作る
+func NewPinnedResponse(code int, header http.Header, body []byte) *CachedResponse {
+	header = header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	return &CachedResponse{
+		Code:          code,
+		ContentLength: len(body),
+		Header:        header,
+		Body:          body,
+	}
+}
+
+// ParsePinHeaders "Name: value" 形式のヘッダ指定を http.Header にする
+func ParsePinHeaders(values []string) (http.Header, error) {
+	header := http.Header{}
+	for _, v := range values {
+		i := strings.IndexByte(v, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid header: %q", v)
+		}
+		header.Add(textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(v[:i])), strings.TrimSpace(v[i+1:]))
+	}
+	return header, nil
+}
+
+// RequireAdminToken 管理用 API に Authorization: Bearer <token> を要求する
+func RequireAdminToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			adminError(w, http.StatusUnauthorized, fmt.Errorf("invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func adminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"Error": err.Error()})
+}
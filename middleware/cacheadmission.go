@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// AdmissionConfig 一度しか来ないようなリクエストでキャッシュが溢れないように、何度かリクエストされたものだけキャッシュに保存する設定
+type AdmissionConfig struct {
+	// Window の間にこの回数リクエストされたらキャッシュに保存する（1以下なら常に保存する）
+	MinHits int
+	// リクエスト回数を数える期間
+	Window time.Duration
+	// 回数を数える count-min sketch の幅（デフォルトは 65536）
+	Width int
+	// パス毎の MinHits（上から順に最初にマッチしたものを使う）
+	Routes []AdmissionRoute
+}
+
+// AdmissionRoute パス毎の MinHits の設定
+type AdmissionRoute struct {
+	// パスのワイルドカード
+	Path    string
+	MinHits int
+}
+
+// admissionFilter は count-min sketch でキー毎のリクエスト回数を概算してキャッシュに保存するかを決める
+// 回数は Window 毎にリセットする
+type admissionFilter struct {
+	minHits int
+	routes  []admissionRoute
+	window  time.Duration
+	width   uint64
+	rows    [admissionDepth][]uint32
+	reset   time.Time
+	m       sync.Mutex
+}
+
+type admissionRoute struct {
+	path    Pattern
+	minHits int
+}
+
+const admissionDepth = 4
+
+func newAdmissionFilter(config *AdmissionConfig) *admissionFilter {
+	af := &admissionFilter{
+		minHits: config.MinHits,
+		window:  config.Window,
+		width:   uint64(config.Width),
+	}
+	if af.width == 0 {
+		af.width = 1 << 16
+	}
+	for _, r := range config.Routes {
+		af.routes = append(af.routes, admissionRoute{NewWildCard(r.Path), r.MinHits})
+	}
+	for i := range af.rows {
+		af.rows[i] = make([]uint32, af.width)
+	}
+	af.reset = time.Now().Add(af.window)
+	return af
+}
+
+// Admit key へのリクエストを数えて、キャッシュに保存してよい回数に達していれば true を返す
+func (af *admissionFilter) Admit(path string, key string) bool {
+	minHits := af.minHits
+	for _, r := range af.routes {
+		if r.path.Match(path) {
+			minHits = r.minHits
+			break
+		}
+	}
+	if minHits <= 1 {
+		return true
+	}
+	return int(af.increment(key)) >= minHits
+}
+
+// increment key の回数を1増やして、増やした後の概算値を返す
+func (af *admissionFilter) increment(key string) uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 := h.Sum64()
+	h2 := h1>>32 | h1<<32 | 1
+	af.m.Lock()
+	defer af.m.Unlock()
+	if 0 < af.window && time.Now().After(af.reset) {
+		for i := range af.rows {
+			af.rows[i] = make([]uint32, af.width)
+		}
+		af.reset = time.Now().Add(af.window)
+	}
+	var min uint32
+	for i := range af.rows {
+		idx := (h1 + uint64(i)*h2) % af.width
+		af.rows[i][idx]++
+		if c := af.rows[i][idx]; i == 0 || c < min {
+			min = c
+		}
+	}
+	return min
+}
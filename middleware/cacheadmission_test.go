@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAdmissionFilter_Admit(t *testing.T) {
+	af := newAdmissionFilter(&AdmissionConfig{
+		MinHits: 3,
+		Window:  time.Hour,
+		Routes: []AdmissionRoute{
+			{Path: "/static/*", MinHits: 0},
+			{Path: "/search*", MinHits: 5},
+		},
+	})
+	tests := []struct {
+		name string
+		path string
+		want []bool
+	}{
+		{"default MinHits", "/a", []bool{false, false, true, true}},
+		{"always admit", "/static/app.js", []bool{true, true}},
+		{"route MinHits", "/search", []bool{false, false, false, false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, want := range tt.want {
+				if got := af.Admit(tt.path, "key:"+tt.path); got != want {
+					t.Errorf("Admit(%v) #%d = %v, want %v", tt.path, i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAdmissionFilter_Window(t *testing.T) {
+	af := newAdmissionFilter(&AdmissionConfig{MinHits: 2, Window: 10 * time.Millisecond})
+	if af.Admit("/", "k") {
+		t.Errorf("first request should not be admitted")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if af.Admit("/", "k") {
+		t.Errorf("counter should be reset after window")
+	}
+	if !af.Admit("/", "k") {
+		t.Errorf("second request in window should be admitted")
+	}
+}
+
+func TestAdmissionFilter_OneHitWonders(t *testing.T) {
+	af := newAdmissionFilter(&AdmissionConfig{MinHits: 2, Window: time.Hour, Width: 1 << 12})
+	admitted := 0
+	for i := 0; i < 1000; i++ {
+		if af.Admit("/", "unique:"+strconv.Itoa(i)) {
+			admitted++
+		}
+	}
+	// count-min sketch は過大評価しかしないが、幅に対して十分少なければ誤判定はほぼ無い
+	if 10 < admitted {
+		t.Errorf("too many one-hit wonders admitted: %v", admitted)
+	}
+}
@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+)
+
+// AnomalyConfig バックエンドが 200 で返した壊れたレスポンス（小さなエラーページなど）でキャッシュを上書きしないためのチェック
+// 怪しいレスポンスはリクエスト元には返すがキャッシュには保存しない
+type AnomalyConfig struct {
+	// ボディが前回より何%以上小さくなったら怪しいとするか（0 ならチェックしない）
+	MaxShrinkPercent int
+	// Content-Type が前回から変わったら怪しいとする
+	ContentTypeChange bool
+	// ボディに含まれているべき文字列
+	RequiredMarkers []AnomalyMarker
+	// 同じ怪しいボディがこの回数続いたら正常な変更とみなして保存する（0 なら保存しない）
+	AcceptAfter int
+}
+
+// AnomalyMarker Path と ContentType にマッチするレスポンスのボディに Marker が含まれているべき
+type AnomalyMarker struct {
+	// パスのワイルドカード（省略時は全て）
+	Path string
+	// Content-Type のワイルドカード（省略時は全て）
+	ContentType string
+	Marker      string
+}
+
+type anomalyChecker struct {
+	maxShrinkPercent  int
+	contentTypeChange bool
+	markers           []anomalyMarker
+	acceptAfter       int
+}
+
+type anomalyMarker struct {
+	path        Pattern
+	contentType Pattern
+	marker      []byte
+}
+
+func newAnomalyChecker(config *AnomalyConfig) *anomalyChecker {
+	ac := &anomalyChecker{
+		maxShrinkPercent:  config.MaxShrinkPercent,
+		contentTypeChange: config.ContentTypeChange,
+		acceptAfter:       config.AcceptAfter,
+	}
+	for _, m := range config.RequiredMarkers {
+		am := anomalyMarker{path: anyPattern, contentType: anyPattern, marker: []byte(m.Marker)}
+		if m.Path != "" {
+			am.path = NewWildCard(m.Path)
+		}
+		if m.ContentType != "" {
+			am.contentType = NewWildCard(m.ContentType)
+		}
+		ac.markers = append(ac.markers, am)
+	}
+	return ac
+}
+
+// Check 新しいレスポンスが怪しければその理由を返す。問題なければ "" を返す
+// 200 以外はそもそも ErrorTTL で扱うのでチェックしない
+func (ac *anomalyChecker) Check(path string, old *CachedResponse, cr *CachedResponse) string {
+	if cr.Code != http.StatusOK {
+		return ""
+	}
+	if old != nil && old.Code == http.StatusOK {
+		if 0 < ac.maxShrinkPercent && 0 < old.ContentLength {
+			shrink := (old.ContentLength - cr.ContentLength) * 100 / old.ContentLength
+			if ac.maxShrinkPercent <= shrink {
+				return fmt.Sprintf("body shrank %d%% (%d -> %d)", shrink, old.ContentLength, cr.ContentLength)
+			}
+		}
+		if ac.contentTypeChange {
+			oldType, _, _ := mime.ParseMediaType(old.Header.Get("Content-Type"))
+			newType, _, _ := mime.ParseMediaType(cr.Header.Get("Content-Type"))
+			if oldType != newType {
+				return fmt.Sprintf("Content-Type changed (%v -> %v)", oldType, newType)
+			}
+		}
+	}
+	var plain []byte
+	for _, m := range ac.markers {
+		if !m.path.Match(path) || !m.contentType.Match(cr.Header.Get("Content-Type")) {
+			continue
+		}
+		if plain == nil {
+			var err error
+			plain, err = decodeContentEncoding(cr.Header, cr.Body)
+			if errors.Is(err, errUnsupportedContentEncoding) {
+				// 展開できないものはマーカーを確かめようがないので通す
+				return ""
+			}
+			if err != nil {
+				return err.Error()
+			}
+		}
+		if !bytes.Contains(plain, m.marker) {
+			return fmt.Sprintf("marker %q is missing", m.marker)
+		}
+	}
+	return ""
+}
+
+// Accept 怪しいと判定された同じボディが AcceptAfter 回続いたかを数える
+// 続いていれば ci の記録を消して true を返す
+func (ac *anomalyChecker) Accept(ci *CacheInfo, bodyHash string) bool {
+	if ac.acceptAfter <= 0 {
+		return false
+	}
+	if ci.SuspectHash != bodyHash {
+		ci.SuspectHash = bodyHash
+		ci.SuspectCount = 0
+	}
+	ci.SuspectCount++
+	if ci.SuspectCount < ac.acceptAfter {
+		return false
+	}
+	ci.SuspectHash = ""
+	ci.SuspectCount = 0
+	return true
+}
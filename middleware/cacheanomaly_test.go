@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAnomalyChecker_Check(t *testing.T) {
+	html := http.Header{"Content-Type": {"text/html; charset=utf-8"}}
+	gzipHTML := http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"gzip"}}
+	res := func(code int, header http.Header, body string) *CachedResponse {
+		return &CachedResponse{Code: code, Header: header, Body: []byte(body), ContentLength: len(body)}
+	}
+	good := res(200, html, strings.Repeat("x", 100)+"</html>")
+	ac := newAnomalyChecker(&AnomalyConfig{
+		MaxShrinkPercent:  50,
+		ContentTypeChange: true,
+		RequiredMarkers: []AnomalyMarker{
+			{ContentType: "text/html*", Marker: "</html>"},
+			{Path: "/api/*", Marker: `"ok":true`},
+		},
+	})
+	tests := []struct {
+		name    string
+		path    string
+		old     *CachedResponse
+		cr      *CachedResponse
+		suspect bool
+	}{
+		{"same", "/", good, good, false},
+		{"new entry", "/", nil, res(200, html, "<html></html>"), false},
+		{"shrank", "/", good, res(200, html, "error</html>"), true},
+		{"shrank but old was error", "/", res(500, html, strings.Repeat("x", 100)), res(200, html, "ok</html>"), false},
+		{"error response is not checked", "/", good, res(503, html, "error"), false},
+		{"content type changed", "/", good, res(200, http.Header{"Content-Type": {"application/json"}}, strings.Repeat("x", 100)), true},
+		{"charset only changed", "/", good, res(200, http.Header{"Content-Type": {"text/html"}}, strings.Repeat("y", 100)+"</html>"), false},
+		{"marker missing", "/", nil, res(200, html, "<html>"), true},
+		{"marker in gzip body", "/", nil, res(200, gzipHTML, string(encodeForTest(t, "gzip", []byte("<html></html>")))), false},
+		{"broken gzip body", "/", nil, res(200, gzipHTML, "<html></html>"), true},
+		{"unsupported encoding is not checked", "/", nil, res(200, http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"zstd"}}, "<html>"), false},
+		{"path marker", "/api/x", nil, res(200, http.Header{}, `{"ok":false}`), true},
+		{"path marker ok", "/api/x", nil, res(200, http.Header{}, `{"ok":true}`), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := ac.Check(tt.path, tt.old, tt.cr)
+			if (reason != "") != tt.suspect {
+				t.Errorf("Check() = %q, suspect want %v", reason, tt.suspect)
+			}
+		})
+	}
+}
+
+func TestAnomalyChecker_Accept(t *testing.T) {
+	ac := newAnomalyChecker(&AnomalyConfig{AcceptAfter: 3})
+	ci := &CacheInfo{}
+	got := []bool{ac.Accept(ci, "a"), ac.Accept(ci, "a"), ac.Accept(ci, "b"), ac.Accept(ci, "b"), ac.Accept(ci, "b")}
+	want := []bool{false, false, false, false, true}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Accept() = %v, want %v", got, want)
+			break
+		}
+	}
+	if never := newAnomalyChecker(&AnomalyConfig{}); never.Accept(ci, "a") {
+		t.Errorf("Accept() without AcceptAfter = true")
+	}
+}
+
+func TestCacheHandler_Anomaly(t *testing.T) {
+	fm := newFakeMemcached(t)
+	var body atomic.Value
+	body.Store("<html>" + strings.Repeat("x", 100) + "</html>")
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(body.Load().(string)))
+	})
+	h := NewCacheHandler(&CacheConfig{
+		MemcachedServers:     []string{fm.Addr()},
+		SoftTTL:              50 * time.Millisecond,
+		HardTTL:              time.Hour,
+		NewResponseWaitLimit: time.Second,
+		Anomaly:              &AnomalyConfig{MaxShrinkPercent: 50},
+	}).Handle(backend)
+	get := func() string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+		return rec.Body.String()
+	}
+	good := body.Load().(string)
+	get()
+	body.Store("<html>error</html>")
+	time.Sleep(60 * time.Millisecond)
+	// 怪しいレスポンスはリクエスト元にはそのまま返す
+	if got := get(); got != "<html>error</html>" {
+		t.Errorf("suspicious response = %q", got)
+	}
+	// キャッシュは上書きされていない
+	if got := get(); got != good {
+		t.Errorf("cached response = %q, want %q", got, good)
+	}
+}
+
+func TestCacheHandler_AnomalyFirstResponse(t *testing.T) {
+	fm := newFakeMemcached(t)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html>error</html>"))
+	})
+	h := NewCacheHandler(&CacheConfig{
+		MemcachedServers:     []string{fm.Addr()},
+		SoftTTL:              time.Minute,
+		HardTTL:              time.Hour,
+		NewResponseWaitLimit: time.Second,
+		Anomaly:              &AnomalyConfig{RequiredMarkers: []AnomalyMarker{{Marker: "</footer>"}}},
+	}).Handle(backend)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+	if got := rec.Body.String(); got != "<html>error</html>" {
+		t.Errorf("suspicious response = %q", got)
+	}
+	// 保存するのは更新の開始時に Expires を伸ばす 1 回だけ（レスポンスの無い CacheInfo を保存し直さない）
+	if got := fm.Count("set"); got != 1 {
+		t.Errorf("set count = %v, want 1", got)
+	}
+}
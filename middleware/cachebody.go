@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	// ボディを CacheInfo とは別のアイテムとして保存する時のキーのプレフィックス
+	bodyKeyPrefix = "cb/"
+	// 共有しているボディのアイテムの有効期限の時刻を記録するアイテムのキーのプレフィックス
+	bodyExpiresKeyPrefix = "cbe/"
+)
+
+// saveBody ci のボディを BodyHash をキーにしたアイテムとして保存して ci.BodyKey に記録する
+// 他の URL と同じボディなら既存のアイテムを共有する。共有しているアイテムの寿命を縮めないように
+// 小さな別アイテム（bodyExpiresKeyPrefix）に有効期限の時刻を記録しておき、それより長く残す必要がある時だけ伸ばす
+// ボディのアイテムは Touch で有効期限を揃えるだけで、無くなっていた時以外は取得も保存もしない
+func (cache *CacheHandler) saveBody(ci *CacheInfo, expiration time.Duration) error {
+	body := ci.CachedResponse.Body
+	if ci.BodyHash == "" {
+		sum := sha256.Sum256(body)
+		ci.BodyHash = Base64.EncodeToString(sum[:])
+	}
+	key := bodyKeyPrefix + ci.BodyHash
+	expiresKey := bodyExpiresKeyPrefix + ci.BodyHash
+	// 共有するので相対時間ではなく時刻で揃える（0 は期限無しなので memcached が扱える最も遠い時刻にする）
+	expires := int64(math.MaxInt32)
+	if exp := int64(expiration.Seconds()); exp != 0 {
+		expires = time.Now().Unix() + exp
+	}
+	// 他のリクエストと同時に保存しようとして競合したらやり直す
+	for i := 0; i < 3; i++ {
+		item, err := cache.MemcachedClient.Get(expiresKey)
+		switch {
+		case err == memcache.ErrCacheMiss:
+			err = cache.MemcachedClient.Add(&memcache.Item{Key: expiresKey, Value: []byte(strconv.FormatInt(expires, 10)), Expiration: int32(expires)})
+		case err != nil:
+		default:
+			if stored, _ := strconv.ParseInt(string(item.Value), 10, 64); expires <= stored {
+				// 既に十分長く残るのでその時刻に揃える
+				expires = stored
+				break
+			}
+			item.Value = []byte(strconv.FormatInt(expires, 10))
+			item.Expiration = int32(expires)
+			err = cache.MemcachedClient.CompareAndSwap(item)
+		}
+		if err == memcache.ErrNotStored || err == memcache.ErrCASConflict {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not save body %v: %v", key, err)
+		}
+		if err := cache.touchBody(key, body, expires); err != nil {
+			return err
+		}
+		ci.BodyKey = key
+		return nil
+	}
+	return fmt.Errorf("could not save body %v: conflicted", key)
+}
+
+// touchBody ボディのアイテムの有効期限を expires の時刻にする。無くなっていたら作り直す
+// （同時に保存した他のリクエストが古い時刻で揃えて縮めてしまっても、次の保存で作り直されるだけで済む）
+func (cache *CacheHandler) touchBody(key string, body []byte, expires int64) error {
+	err := cache.MemcachedClient.Touch(key, int32(expires))
+	if err == memcache.ErrCacheMiss {
+		var value []byte
+		if value, err = cache.encodeValue(key, body); err != nil {
+			return err
+		}
+		err = cache.MemcachedClient.Add(&memcache.Item{Key: key, Value: value, Expiration: int32(expires)})
+		if err == memcache.ErrNotStored {
+			// 他のリクエストが作った
+			err = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("could not save body %v: %v", key, err)
+	}
+	return nil
+}
+
+// loadBody BodyKey のアイテムからボディを取り出して BodyHash と一致するか確かめる
+func (cache *CacheHandler) loadBody(ci *CacheInfo) ([]byte, error) {
+	item, err := cache.MemcachedClient.Get(ci.BodyKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not load body %v: %v", ci.BodyKey, err)
+	}
+	body, err := cache.decodeValue(item.Key, item.Value)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	if Base64.EncodeToString(sum[:]) != ci.BodyHash {
+		return nil, fmt.Errorf("body hash mismatch %v", ci.BodyKey)
+	}
+	return body, nil
+}
@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheHandler_BodyDedup(t *testing.T) {
+	fm := newFakeMemcached(t)
+	var body atomic.Value
+	body.Store("hello")
+	var hits int32
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte(body.Load().(string)))
+	})
+	cache := NewCacheHandler(&CacheConfig{
+		MemcachedServers:     []string{fm.Addr()},
+		SoftTTL:              50 * time.Millisecond,
+		HardTTL:              time.Hour,
+		NewResponseWaitLimit: time.Second,
+		BodyDedup:            true,
+	})
+	h := cache.Handle(backend)
+	get := func(path string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com"+path, nil))
+		return rec.Body.String()
+	}
+	bodyKeys := func() (keys []string) {
+		for _, k := range fm.Keys() {
+			if strings.HasPrefix(k, bodyKeyPrefix) {
+				keys = append(keys, k)
+			}
+		}
+		return keys
+	}
+
+	// 同じボディの URL はボディを共有する
+	get("/a")
+	get("/b")
+	if got := len(bodyKeys()); got != 1 {
+		t.Errorf("body items = %v, want 1", got)
+	}
+	// キャッシュヒットでもボディが復元される
+	if got := get("/a"); got != "hello" || atomic.LoadInt32(&hits) != 2 {
+		t.Errorf("cached body = %q, backend hits = %v", got, hits)
+	}
+	// ボディが変わらない更新ではボディを作り直さないし、保存のためにボディを取得もしない
+	adds := fm.Count("add")
+	bodyKey := bodyKeys()[0]
+	fetched := fm.Fetched(bodyKey)
+	time.Sleep(60 * time.Millisecond)
+	if got := get("/a"); got != "hello" || atomic.LoadInt32(&hits) != 3 {
+		t.Errorf("refreshed body = %q, backend hits = %v", got, hits)
+	}
+	if got := fm.Count("add"); got != adds {
+		t.Errorf("add count = %v, want %v", got, adds)
+	}
+	// 取得するのはキャッシュを読み込んだ時の 1 回だけ
+	if got := fm.Fetched(bodyKey) - fetched; got != 1 {
+		t.Errorf("body fetched %v times on refresh, want 1", got)
+	}
+	// ボディが変わったら新しいボディのアイテムを作る
+	body.Store("world")
+	time.Sleep(60 * time.Millisecond)
+	if got := get("/a"); got != "world" {
+		t.Errorf("refreshed body = %q, want world", got)
+	}
+	if got := len(bodyKeys()); got != 2 {
+		t.Errorf("body items = %v, want 2", got)
+	}
+	if got := get("/a"); got != "world" {
+		t.Errorf("cached body = %q, want world", got)
+	}
+}
+
+func TestCacheHandler_saveBody_expiration(t *testing.T) {
+	fm := newFakeMemcached(t)
+	cache := NewCacheHandler(&CacheConfig{
+		MemcachedServers: []string{fm.Addr()},
+		BodyDedup:        true,
+	}).(*CacheHandler)
+	var bodyKey string
+	save := func(expiration time.Duration) time.Duration {
+		ci := &CacheInfo{CachedResponse: &CachedResponse{Body: []byte("shared")}}
+		if err := cache.saveBody(ci, expiration); err != nil {
+			t.Fatal(err)
+		}
+		bodyKey = ci.BodyKey
+		return time.Until(fm.Expires(ci.BodyKey))
+	}
+	// 長い TTL の URL と共有しているボディは短い TTL の URL に縮められない
+	if got := save(time.Hour); got < 59*time.Minute {
+		t.Errorf("expiration = %v, want about 1h", got)
+	}
+	if got := save(time.Minute); got < 59*time.Minute {
+		t.Errorf("expiration after short save = %v, want about 1h", got)
+	}
+	// 長い方には伸ばす
+	if got := save(2 * time.Hour); got < 119*time.Minute {
+		t.Errorf("expiration after long save = %v, want about 2h", got)
+	}
+	// 保存でボディを取得することはない
+	if got := fm.Fetched(bodyKey); got != 0 {
+		t.Errorf("body fetched %v times by saveBody", got)
+	}
+	// 無くなっていたら作り直す
+	fm.m.Lock()
+	for k := range fm.items {
+		if strings.HasPrefix(k, bodyKeyPrefix) {
+			delete(fm.items, k)
+		}
+	}
+	fm.m.Unlock()
+	if got := save(time.Minute); got < 119*time.Minute {
+		t.Errorf("expiration after recreate = %v, want about 2h", got)
+	}
+}
@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClientTTLRoute zunproxy 自身のキャッシュ期間とは別に、クライアントに返す Cache-Control/Expires をパス毎に書き換える設定
+type ClientTTLRoute struct {
+	// パスのワイルドカード
+	Path string
+	// クライアントにキャッシュさせる期間
+	MaxAge time.Duration
+	// max-age と一緒に Cache-Control に入れるディレクティブ（例: "public", "private, must-revalidate"）
+	Directives string
+}
+
+type clientTTLRoute struct {
+	path       Pattern
+	maxAge     time.Duration
+	directives string
+}
+
+func newClientTTLRoutes(routes []ClientTTLRoute) []*clientTTLRoute {
+	var ctrs []*clientTTLRoute
+	for _, r := range routes {
+		ctrs = append(ctrs, &clientTTLRoute{NewWildCard(r.Path), r.MaxAge, r.Directives})
+	}
+	return ctrs
+}
+
+// Rewrite fetched にバックエンドから取得したレスポンスのヘッダを書き換える
+// Age はキャッシュしていた期間で、max-age は Age を足して今からクライアントが MaxAge の間キャッシュできるようにする
+// バックエンドが private や no-store を指定したものはユーザ毎のレスポンスかもしれないのでそのままにする
+func (ctr *clientTTLRoute) Rewrite(header http.Header, fetched time.Time) {
+	if hasCacheControlDirective(header, "private", "no-store") {
+		return
+	}
+	now := time.Now()
+	age := now.Sub(fetched).Truncate(time.Second)
+	if age < 0 {
+		age = 0
+	}
+	cc := fmt.Sprintf("max-age=%d", int64((age + ctr.maxAge).Seconds()))
+	if ctr.directives != "" {
+		cc = ctr.directives + ", " + cc
+	}
+	header.Set("Cache-Control", cc)
+	header.Set("Expires", now.Add(ctr.maxAge).UTC().Format(http.TimeFormat))
+	header.Set("Age", strconv.FormatInt(int64(age.Seconds()), 10))
+}
+
+// hasCacheControlDirective Cache-Control に names のどれかのディレクティブがあるか
+// private="Set-Cookie" のようにフィールド名付きのものも含む
+func hasCacheControlDirective(header http.Header, names ...string) bool {
+	for _, v := range header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name := strings.TrimSpace(d)
+			if i := strings.IndexByte(name, '='); i >= 0 {
+				name = strings.TrimSpace(name[:i])
+			}
+			for _, n := range names {
+				if strings.EqualFold(name, n) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// clientWriter クライアントに返す直前にレスポンスヘッダを書き換える
+func (cache *CacheHandler) clientWriter(w http.ResponseWriter, r *http.Request, fetched time.Time) http.ResponseWriter {
+	for _, ctr := range cache.clientTTL {
+		if ctr.path.Match(r.URL.Path) {
+			return &clientTTLWriter{ResponseWriter: w, route: ctr, fetched: fetched}
+		}
+	}
+	return w
+}
+
+// clientTTLWriter は WriteHeader の時に clientTTLRoute でヘッダを書き換える http.ResponseWriter
+type clientTTLWriter struct {
+	http.ResponseWriter
+	route       *clientTTLRoute
+	fetched     time.Time
+	wroteHeader bool
+}
+
+func (cw *clientTTLWriter) WriteHeader(code int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		// エラーはバックエンドの指定のままにする
+		if code < http.StatusBadRequest {
+			cw.route.Rewrite(cw.Header(), cw.fetched)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *clientTTLWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *clientTTLWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *clientTTLWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	_ = http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *clientTTLWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(cw.ResponseWriter).Hijack()
+}
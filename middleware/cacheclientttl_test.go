@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientTTLRoute_Rewrite(t *testing.T) {
+	ctr := newClientTTLRoutes([]ClientTTLRoute{{Path: "*", MaxAge: 30 * time.Second, Directives: "public"}})[0]
+	header := http.Header{"Cache-Control": {"max-age=600"}}
+	ctr.Rewrite(header, time.Now().Add(-100*time.Second))
+	if got, want := header.Get("Cache-Control"), "public, max-age=130"; got != want {
+		t.Errorf("Cache-Control = %v, want %v", got, want)
+	}
+	if got := header.Get("Age"); got != "100" {
+		t.Errorf("Age = %v, want 100", got)
+	}
+	expires, err := http.ParseTime(header.Get("Expires"))
+	if d := time.Until(expires); err != nil || d < 28*time.Second || 31*time.Second < d {
+		t.Errorf("Expires = %v (%v)", header.Get("Expires"), err)
+	}
+}
+
+func TestClientTTLRoute_RewritePrivate(t *testing.T) {
+	ctr := newClientTTLRoutes([]ClientTTLRoute{{Path: "*", MaxAge: 30 * time.Second, Directives: "public"}})[0]
+	// ユーザ毎や保存禁止のレスポンスはクライアントにキャッシュさせない
+	for _, cc := range []string{"private, max-age=0", "No-Store", `max-age=60, private="Set-Cookie"`} {
+		header := http.Header{"Cache-Control": {cc}}
+		ctr.Rewrite(header, time.Now().Add(-100*time.Second))
+		if got := header.Get("Cache-Control"); got != cc || header.Get("Expires") != "" || header.Get("Age") != "" {
+			t.Errorf("Rewrite(%q) = %v", cc, header)
+		}
+	}
+}
+
+func TestCacheHandler_ClientTTL(t *testing.T) {
+	fm := newFakeMemcached(t)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=600")
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte("ok"))
+	})
+	cache := NewCacheHandler(&CacheConfig{
+		MemcachedServers:     []string{fm.Addr()},
+		SoftTTL:              time.Hour,
+		HardTTL:              time.Hour,
+		NewResponseWaitLimit: time.Second,
+		ClientTTL: []ClientTTLRoute{
+			{Path: "/static/*", MaxAge: time.Hour},
+			{Path: "*", MaxAge: 30 * time.Second, Directives: "private"},
+		},
+	}).(*CacheHandler)
+	h := cache.Handle(backend)
+	get := func(path string) http.Header {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com"+path, nil))
+		return rec.Header()
+	}
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"new", "/a", "private, max-age=30"},
+		{"hit", "/a", "private, max-age=30"},
+		{"route", "/static/a.js", "max-age=3600"},
+		{"error is not rewritten", "/error", "max-age=600"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := get(tt.path).Get("Cache-Control"); got != tt.want {
+				t.Errorf("Cache-Control = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	// キャッシュにはバックエンドのヘッダのまま保存されている
+	ci, _ := cache.getCacheInfo("GET example.com/a?")
+	if got := ci.CachedResponse.Header.Get("Cache-Control"); got != "max-age=600" || ci.CachedResponse.Header.Get("Age") != "" {
+		t.Errorf("cached Cache-Control = %v, Age = %v", got, ci.CachedResponse.Header.Get("Age"))
+	}
+}
@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// CacheEncryptionConfig memcached に保存する値を AES-GCM で暗号化する設定
+type CacheEncryptionConfig struct {
+	// 暗号化に使う鍵ID（Keys か KeyFiles に含まれている必要がある）
+	KeyID string
+	// 鍵ID => 鍵(base64)。鍵長は 16/24/32 byte
+	Keys map[string]string
+	// 鍵ID => 鍵ファイルのパス。中身は base64 か生の鍵
+	KeyFiles map[string]string
+}
+
+// 暗号化された値の先頭に付けるマーカー
+var encryptedValueMagic = []byte("zpE1")
+
+var errCacheDecrypt = errors.New("could not decrypt cache value")
+
+// valueCipher は memcached の値を鍵IDつきで暗号化/復号する
+// 値の形式: magic + len(keyID) + keyID + nonce + ciphertext
+// memcached のキーと鍵IDは追加認証データにしているので、他のキーへの値のすげ替えも検出できる
+type valueCipher struct {
+	keyID string
+	aeads map[string]cipher.AEAD
+}
+
+func newValueCipher(config *CacheEncryptionConfig) (*valueCipher, error) {
+	keys := map[string][]byte{}
+	for id, s := range config.Keys {
+		key, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode key %q: %v", id, err)
+		}
+		keys[id] = key
+	}
+	for id, file := range config.KeyFiles {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read key file %q: %v", id, err)
+		}
+		keys[id] = decodeKeyFile(b)
+	}
+	vc := &valueCipher{
+		keyID: config.KeyID,
+		aeads: map[string]cipher.AEAD{},
+	}
+	for id, key := range keys {
+		if len(id) == 0 || 255 < len(id) {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %v", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %v", id, err)
+		}
+		vc.aeads[id] = aead
+	}
+	if _, ok := vc.aeads[vc.keyID]; !ok {
+		return nil, fmt.Errorf("key %q is not found", vc.keyID)
+	}
+	return vc, nil
+}
+
+// 鍵ファイルの中身が base64 として妥当な鍵ならそれを、そうでなければ生の鍵として扱う
+func decodeKeyFile(b []byte) []byte {
+	if key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b))); err == nil {
+		switch len(key) {
+		case 16, 24, 32:
+			return key
+		}
+	}
+	return b
+}
+
+func (vc *valueCipher) aad(mcKey string, keyID string) []byte {
+	return []byte(mcKey + "\x00" + keyID)
+}
+
+// Seal plain を現在の鍵で暗号化する
+func (vc *valueCipher) Seal(mcKey string, plain []byte) ([]byte, error) {
+	aead := vc.aeads[vc.keyID]
+	header := make([]byte, 0, len(encryptedValueMagic)+1+len(vc.keyID)+aead.NonceSize())
+	header = append(header, encryptedValueMagic...)
+	header = append(header, byte(len(vc.keyID)))
+	header = append(header, vc.keyID...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("could not generate nonce: %v", err)
+	}
+	header = append(header, nonce...)
+	return aead.Seal(header, nonce, plain, vc.aad(mcKey, vc.keyID)), nil
+}
+
+// Open value を値に書かれた鍵IDの鍵で復号する。認証に失敗したら errCacheDecrypt を返す
+func (vc *valueCipher) Open(mcKey string, value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, encryptedValueMagic) {
+		return nil, fmt.Errorf("%w: not encrypted", errCacheDecrypt)
+	}
+	value = value[len(encryptedValueMagic):]
+	if len(value) < 1 || len(value) < 1+int(value[0]) {
+		return nil, fmt.Errorf("%w: broken header", errCacheDecrypt)
+	}
+	keyID := string(value[1 : 1+int(value[0])])
+	value = value[1+len(keyID):]
+	aead, ok := vc.aeads[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key id %q", errCacheDecrypt, keyID)
+	}
+	if len(value) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: broken nonce", errCacheDecrypt)
+	}
+	plain, err := aead.Open(nil, value[:aead.NonceSize()], value[aead.NonceSize():], vc.aad(mcKey, keyID))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCacheDecrypt, err)
+	}
+	return plain, nil
+}
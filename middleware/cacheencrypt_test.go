@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKey(c byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{c}, 32))
+}
+
+func TestValueCipher(t *testing.T) {
+	plain := []byte(`{"Key":"ch/XXXX"}`)
+	old, err := newValueCipher(&CacheEncryptionConfig{
+		KeyID: "k1",
+		Keys:  map[string]string{"k1": testKey('1')},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := newValueCipher(&CacheEncryptionConfig{
+		KeyID: "k2",
+		Keys:  map[string]string{"k1": testKey('1'), "k2": testKey('2')},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := old.Seal("ch/XXXX", plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, plain) {
+		t.Errorf("sealed value contains plain text")
+	}
+
+	t.Run("roundtrip", func(t *testing.T) {
+		got, err := old.Open("ch/XXXX", sealed)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("Open() = %q, %v", got, err)
+		}
+	})
+	t.Run("rotated key can open old value", func(t *testing.T) {
+		got, err := rotated.Open("ch/XXXX", sealed)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("Open() = %q, %v", got, err)
+		}
+	})
+	t.Run("old key can not open new value", func(t *testing.T) {
+		sealed2, _ := rotated.Seal("ch/XXXX", plain)
+		if _, err := old.Open("ch/XXXX", sealed2); !errors.Is(err, errCacheDecrypt) {
+			t.Errorf("Open() error = %v, want errCacheDecrypt", err)
+		}
+	})
+	fails := map[string]struct {
+		key   string
+		value []byte
+	}{
+		"tampered": {"ch/XXXX", func() []byte {
+			b := append([]byte{}, sealed...)
+			b[len(b)-1] ^= 1
+			return b
+		}()},
+		"other memcached key": {"ch/YYYY", sealed},
+		"plain value":         {"ch/XXXX", plain},
+		"truncated":           {"ch/XXXX", sealed[:len(encryptedValueMagic)+2]},
+	}
+	for name, tt := range fails {
+		t.Run(name, func(t *testing.T) {
+			if _, err := old.Open(tt.key, tt.value); !errors.Is(err, errCacheDecrypt) {
+				t.Errorf("Open() error = %v, want errCacheDecrypt", err)
+			}
+		})
+	}
+}
+
+func TestNewValueCipher(t *testing.T) {
+	dir := t.TempDir()
+	rawKeyFile := filepath.Join(dir, "raw.key")
+	os.WriteFile(rawKeyFile, bytes.Repeat([]byte{'r'}, 16), 0600)
+	b64KeyFile := filepath.Join(dir, "b64.key")
+	os.WriteFile(b64KeyFile, []byte(testKey('b')+"\n"), 0600)
+	tests := []struct {
+		name    string
+		config  *CacheEncryptionConfig
+		wantErr bool
+	}{
+		{"key", &CacheEncryptionConfig{KeyID: "a", Keys: map[string]string{"a": testKey('a')}}, false},
+		{"raw key file", &CacheEncryptionConfig{KeyID: "r", KeyFiles: map[string]string{"r": rawKeyFile}}, false},
+		{"base64 key file", &CacheEncryptionConfig{KeyID: "b", KeyFiles: map[string]string{"b": b64KeyFile}}, false},
+		{"missing key id", &CacheEncryptionConfig{KeyID: "x", Keys: map[string]string{"a": testKey('a')}}, true},
+		{"bad key length", &CacheEncryptionConfig{KeyID: "a", Keys: map[string]string{"a": "YWJj"}}, true},
+		{"missing key file", &CacheEncryptionConfig{KeyID: "a", KeyFiles: map[string]string{"a": filepath.Join(dir, "none")}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newValueCipher(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newValueCipher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
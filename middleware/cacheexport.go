@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/goccy/go-json"
+)
+
+// CacheExportEntry memcached クラスタ間でキャッシュを移すための1エントリ分の情報
+type CacheExportEntry struct {
+	// memcached のキー
+	Key string
+	// Request を表す文字列
+	KeySource string
+	// エクスポートした時刻
+	Exported time.Time
+	// エクスポートした時点での memcached の残り有効期間
+	TTL time.Duration
+	// CacheInfo(JSON)。暗号化が有効でも復号した状態で持つので取り扱いに注意
+	Value json.RawMessage
+}
+
+// ExportEntry keySource のキャッシュを取り出す。キャッシュが無ければ nil を返す
+func (cache *CacheHandler) ExportEntry(keySource string) (*CacheExportEntry, error) {
+	ci, err := cache.getCacheInfo(keySource)
+	if err != nil {
+		return nil, err
+	}
+	if ci.CachedResponse == nil {
+		return nil, nil
+	}
+	saved := ci.Saved
+	if saved.IsZero() {
+		// Saved が無い古いエントリは最後の更新時刻で代用する
+		saved = ci.Updated
+	}
+	now := time.Now()
+	ttl := saved.Add(cache.config.HardTTL).Sub(now).Truncate(time.Second)
+	if ttl <= 0 {
+		return nil, nil
+	}
+	return &CacheExportEntry{
+		Key:       ci.Key,
+		KeySource: ci.KeySource,
+		Exported:  now,
+		TTL:       ttl,
+		Value:     ci.Bytes(),
+	}, nil
+}
+
+// ImportEntry e を memcached に書き込む。エクスポートからの経過時間を差し引いて期限切れなら書き込まずに false を返す
+func (cache *CacheHandler) ImportEntry(e *CacheExportEntry) (bool, error) {
+	ttl := e.TTL - time.Since(e.Exported)
+	if ttl < time.Second {
+		return false, nil
+	}
+	var ci CacheInfo
+	if err := json.Unmarshal(e.Value, &ci); err != nil {
+		return false, fmt.Errorf("could not unmarshal CacheInfo %v: %v", e.Key, err)
+	}
+	if ci.Key != e.Key {
+		return false, fmt.Errorf("key mismatch: %v != %v", ci.Key, e.Key)
+	}
+	// 過去の世代のアイテムは移さないので参照も消しておく
+	ci.Versions = nil
+	// HardTTL の残りが ttl になるように保存時刻をずらしておく
+	ci.Saved = time.Now().Add(ttl - cache.config.HardTTL)
+	ci.mcItem = &memcache.Item{Key: e.Key}
+	err := cache.saveCacheInfo(&ci, ttl)
+	if err != nil {
+		return false, fmt.Errorf("could not save %v: %v", e.Key, err)
+	}
+	cache.indexKey(ci.KeySource)
+	return true, nil
+}
+
+// 同じ keySource を何度も追記しないために覚えておく最大数（超えたら忘れてやり直す）
+const keyIndexSeenLimit = 100_000
+
+// indexKey KeyIndexFile に keySource を追記する（保存に成功したキャッシュだけ呼ぶこと）
+func (cache *CacheHandler) indexKey(keySource string) {
+	if cache.keyIndex == nil {
+		return
+	}
+	cache.keyIndexM.Lock()
+	defer cache.keyIndexM.Unlock()
+	if _, ok := cache.keyIndexSeen[keySource]; ok {
+		return
+	}
+	if keyIndexSeenLimit <= len(cache.keyIndexSeen) {
+		cache.keyIndexSeen = map[string]struct{}{}
+	}
+	if _, err := io.WriteString(cache.keyIndex, keySource+"\n"); err != nil {
+		log.Printf("could not write KeyIndexFile: %v", err)
+		return
+	}
+	cache.keyIndexSeen[keySource] = struct{}{}
+}
+
+// ReadKeyIndex KeyIndexFile の形式（1行1キー元）を読み込んで重複を除いた keySource を返す
+func ReadKeyIndex(r io.Reader) ([]string, error) {
+	var keySources []string
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		ks := strings.TrimSpace(scanner.Text())
+		if ks == "" || seen[ks] {
+			continue
+		}
+		seen[ks] = true
+		keySources = append(keySources, ks)
+	}
+	return keySources, scanner.Err()
+}
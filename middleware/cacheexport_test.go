@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadKeyIndex(t *testing.T) {
+	in := "GET example.com/a?\n\nGET example.com/b?x=1\n  GET example.com/a?  \nPOST example.com/graphql? body=XXXX\n"
+	got, err := ReadKeyIndex(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"GET example.com/a?", "GET example.com/b?x=1", "POST example.com/graphql? body=XXXX"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadKeyIndex() = %v, want %v", got, want)
+	}
+}
+
+func TestCacheHandler_ExportImport(t *testing.T) {
+	tests := []struct {
+		name   string
+		config CacheConfig
+	}{
+		{"plain", CacheConfig{}},
+		{"encrypted", CacheConfig{Encryption: &CacheEncryptionConfig{KeyID: "a", Keys: map[string]string{"a": testKey('a')}}}},
+		{"body dedup", CacheConfig{BodyDedup: true}},
+		{"encrypted body dedup", CacheConfig{BodyDedup: true, Encryption: &CacheEncryptionConfig{KeyID: "a", Keys: map[string]string{"a": testKey('a')}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fm := newFakeMemcached(t)
+			var hits int32
+			backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&hits, 1)
+				w.Header().Set("X-Test", "1")
+				w.Write([]byte("hello " + r.URL.Path))
+			})
+			config := tt.config
+			config.MemcachedServers = []string{fm.Addr()}
+			config.SoftTTL = time.Minute
+			config.HardTTL = time.Hour
+			config.NewResponseWaitLimit = time.Second
+			cache := NewCacheHandler(&config).(*CacheHandler)
+			h := cache.Handle(backend)
+			get := func(path string) *httptest.ResponseRecorder {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com"+path, nil))
+				return rec
+			}
+			get("/a")
+			get("/b")
+
+			var entries []*CacheExportEntry
+			for _, ks := range []string{"GET example.com/a?", "GET example.com/b?", "GET example.com/none?"} {
+				e, err := cache.ExportEntry(ks)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if e != nil {
+					entries = append(entries, e)
+				}
+			}
+			if len(entries) != 2 {
+				t.Fatalf("exported %v entries, want 2", len(entries))
+			}
+			if tt.config.Encryption != nil && !bytes.Contains(entries[0].Value, []byte(`"X-Test"`)) {
+				// エクスポートしたものは復号してある
+				t.Errorf("exported value is not decrypted: %s", entries[0].Value)
+			}
+
+			if err := cache.MemcachedClient.FlushAll(); err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if ok, err := cache.ImportEntry(e); !ok || err != nil {
+					t.Fatalf("ImportEntry(%v) = %v, %v", e.KeySource, ok, err)
+				}
+			}
+			if tt.config.BodyDedup && len(fm.Keys()) <= 2 {
+				t.Errorf("body items are not imported: %v", fm.Keys())
+			}
+			// インポートしたキャッシュがバックエンドに流さずに返る
+			for _, path := range []string{"/a", "/b"} {
+				rec := get(path)
+				if rec.Body.String() != "hello "+path || rec.Header().Get("X-Test") != "1" {
+					t.Errorf("imported %v = %q %v", path, rec.Body.String(), rec.Header())
+				}
+			}
+			if got := atomic.LoadInt32(&hits); got != 2 {
+				t.Errorf("backend hits = %v, want 2", got)
+			}
+			// 残りの期限は引き継ぐ
+			ci, _ := cache.getCacheInfo("GET example.com/a?")
+			if ttl := time.Until(ci.Saved.Add(time.Hour)); ttl < 59*time.Minute || time.Hour < ttl {
+				t.Errorf("remaining HardTTL = %v", ttl)
+			}
+		})
+	}
+}
+
+func TestCacheHandler_ImportExpired(t *testing.T) {
+	fm := newFakeMemcached(t)
+	cache := NewCacheHandler(&CacheConfig{MemcachedServers: []string{fm.Addr()}, HardTTL: time.Hour}).(*CacheHandler)
+	e := &CacheExportEntry{Key: "x", Exported: time.Now().Add(-2 * time.Second), TTL: 2 * time.Second, Value: []byte(`{}`)}
+	if ok, err := cache.ImportEntry(e); ok || err != nil {
+		t.Errorf("ImportEntry() of expired entry = %v, %v", ok, err)
+	}
+	if len(fm.Keys()) != 0 {
+		t.Errorf("expired entry is stored: %v", fm.Keys())
+	}
+}
+
+func TestCacheHandler_KeyIndex(t *testing.T) {
+	fm := newFakeMemcached(t)
+	index := filepath.Join(t.TempDir(), "keys.txt")
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/big" {
+			w.Write(bytes.Repeat([]byte("x"), 100))
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	cache := NewCacheHandler(&CacheConfig{
+		MemcachedServers:     []string{fm.Addr()},
+		SoftTTL:              time.Minute,
+		HardTTL:              time.Hour,
+		NewResponseWaitLimit: time.Second,
+		BytesLimit:           10,
+		KeyIndexFile:         index,
+	}).(*CacheHandler)
+	h := cache.Handle(backend)
+	for _, path := range []string{"/a", "/a", "/big", "/b"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com"+path, nil))
+	}
+	// 作り直しても同じキーは一度だけ書く
+	fm.m.Lock()
+	fm.items = map[string]*fakeItem{}
+	fm.m.Unlock()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/a", nil))
+	got, err := os.ReadFile(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 保存できなかったもの（BytesLimit 超え）は書かない
+	if want := "GET example.com/a?\nGET example.com/b?\n"; string(got) != want {
+		t.Errorf("KeyIndexFile = %q, want %q", got, want)
+	}
+}
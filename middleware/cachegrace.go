@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"time"
+)
+
+// GraceConfig バックエンドの障害中に最後の正常なキャッシュを残し続ける設定
+type GraceConfig struct {
+	// 障害が始まってからこの期間までは最後の正常なキャッシュを障害時のレスポンスで上書きせず、HardTTL が過ぎても残す
+	MaxOutage time.Duration
+	// 障害中に更新を再試行する間隔（デフォルトは ErrorTTL か SoftTTL）
+	RetryInterval time.Duration
+}
+
+// キャッシュの障害対応の状況（/debug/vars の zunproxy_cache）
+var cacheMetrics = expvar.NewMap("zunproxy_cache")
+
+// isBackendFailure バックエンドの障害とみなすレスポンスか
+func isBackendFailure(code int) bool {
+	return code >= http.StatusInternalServerError
+}
+
+// keepDuringOutage 更新が失敗した時に、障害の期間が MaxOutage 以内なら最後の正常なキャッシュを延命して true を返す
+func (cache *CacheHandler) keepDuringOutage(ci *CacheInfo, code int) bool {
+	grace := cache.config.Grace
+	if grace == nil || ci.CachedResponse == nil || isBackendFailure(ci.CachedResponse.Code) {
+		return false
+	}
+	now := time.Now()
+	if ci.OutageSince.IsZero() {
+		ci.OutageSince = now
+		cacheMetrics.Add("outage_started", 1)
+		log.Printf("%v %v code=%v %v", "OUTAGE", ci.Key, code, ci.KeySource)
+	}
+	remaining := ci.OutageSince.Add(grace.MaxOutage).Sub(now)
+	if remaining <= 0 {
+		cacheMetrics.Add("outage_expired", 1)
+		log.Printf("%v %v outage=%v code=%v %v >MaxOutage(%v)", "OUTAGEX", ci.Key, now.Sub(ci.OutageSince).Truncate(time.Second), code, ci.KeySource, grace.MaxOutage)
+		ci.OutageSince = time.Time{}
+		return false
+	}
+	retry := grace.RetryInterval
+	if retry <= 0 {
+		var ok bool
+		if retry, ok = cache.config.ErrorTTL[code]; !ok || retry <= 0 {
+			retry = cache.config.SoftTTL
+		}
+	}
+	// HardTTL が過ぎても MaxOutage までは残るように有効期限を伸ばす
+	expiration := cache.config.HardTTL
+	if expiration < remaining {
+		expiration = remaining
+	}
+	ci.Expires = now.Add(retry)
+	if err := cache.saveCacheInfo(ci, expiration); err != nil {
+		log.Printf("could not save CacheInfo: %v", err)
+	}
+	cacheMetrics.Add("grace_kept", 1)
+	log.Printf("%v %v outage=%v code=%v %v", "GRACE", ci.Key, now.Sub(ci.OutageSince).Truncate(time.Second), code, ci.KeySource)
+	return true
+}
+
+// recoverFromOutage 障害中だったキャッシュが正常に更新できたら障害の記録を消す
+func (cache *CacheHandler) recoverFromOutage(ci *CacheInfo) {
+	if ci.OutageSince.IsZero() {
+		return
+	}
+	cacheMetrics.Add("outage_recovered", 1)
+	log.Printf("%v %v outage=%v %v", "RECOVER", ci.Key, time.Since(ci.OutageSince).Truncate(time.Second), ci.KeySource)
+	ci.OutageSince = time.Time{}
+}
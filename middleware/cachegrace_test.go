@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheHandler_Grace(t *testing.T) {
+	fm := newFakeMemcached(t)
+	var code int32 = http.StatusOK
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := int(atomic.LoadInt32(&code))
+		w.WriteHeader(c)
+		w.Write([]byte(http.StatusText(c)))
+	})
+	cache := NewCacheHandler(&CacheConfig{
+		MemcachedServers:     []string{fm.Addr()},
+		SoftTTL:              time.Minute,
+		HardTTL:              time.Second,
+		NewResponseWaitLimit: time.Second,
+		Grace:                &GraceConfig{MaxOutage: 3 * time.Second},
+	}).(*CacheHandler)
+	h := cache.Handle(backend)
+	keySource := "GET example.com/?"
+	// 待つ代わりに SoftTTL 切れの状態にしてからリクエストする
+	get := func() string {
+		if ci, _ := cache.getCacheInfo(keySource); ci.CachedResponse != nil {
+			expireCacheInfo(t, cache, keySource, nil)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+		return rec.Body.String()
+	}
+	metric := func(key string) int64 {
+		if v, ok := cacheMetrics.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	started := metric("outage_started")
+
+	get()
+	atomic.StoreInt32(&code, http.StatusServiceUnavailable)
+	for i := 0; i < 3; i++ {
+		if got := get(); got != "OK" {
+			t.Fatalf("response during outage = %q, want OK", got)
+		}
+	}
+	ci, _ := cache.getCacheInfo(keySource)
+	if ci.OutageSince.IsZero() || ci.CachedResponse.Code != http.StatusOK {
+		t.Errorf("OutageSince = %v, Code = %v", ci.OutageSince, ci.CachedResponse.Code)
+	}
+	// HardTTL を超えて MaxOutage まで残す
+	if exp := time.Until(fm.Expires(ci.Key)); exp < 1500*time.Millisecond {
+		t.Errorf("expiration = %v, want about MaxOutage", exp)
+	}
+	if metric("outage_started") != started+1 {
+		t.Errorf("outage_started metric is not incremented")
+	}
+
+	atomic.StoreInt32(&code, http.StatusOK)
+	get()
+	ci, _ = cache.getCacheInfo(keySource)
+	if !ci.OutageSince.IsZero() {
+		t.Errorf("OutageSince = %v after recovery", ci.OutageSince)
+	}
+
+	// MaxOutage を過ぎたら障害時のレスポンスで上書きする
+	atomic.StoreInt32(&code, http.StatusBadGateway)
+	if got := get(); got != "OK" {
+		t.Fatalf("response at the start of outage = %q, want OK", got)
+	}
+	expireCacheInfo(t, cache, keySource, func(ci *CacheInfo) {
+		ci.OutageSince = time.Now().Add(-cache.config.Grace.MaxOutage)
+	})
+	if got := get(); got != "Bad Gateway" {
+		t.Errorf("response after MaxOutage = %q, want Bad Gateway", got)
+	}
+}
@@ -5,8 +5,13 @@ import (
 	"context"
 	"crypto/sha256"
 	"fmt"
+	"hash"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"log"
@@ -33,26 +38,124 @@ type CacheConfig struct {
 	HardTTL time.Duration
 	// キャッシュ更新時にバックエンドからの最新レスポンスを待つ時間。バックエンドのレスポンスがこれより遅い場合は古いキャッシュを返す。
 	NewResponseWaitLimit time.Duration
+	// キャッシュ更新でバックエンドを待つ最大時間。超えたら更新を諦めてキャッシュはそのままにする（0 なら無制限。新規のキャッシュ作成には使わない）
+	RefreshTimeout time.Duration
+	// 同時に実行するバックグラウンドでのキャッシュ更新の最大数。超えた分は更新せずに古いキャッシュを返す（0 なら無制限）
+	MaxRefreshes int
+	// NewResponseWaitLimit をキー毎のバックエンドの応答時間に合わせて調整する（nil なら常に NewResponseWaitLimit を使う）
+	AdaptiveWait *AdaptiveWaitConfig
 	// バックエンドのレスポンスコードに応じたTTL
 	ErrorTTL map[int]time.Duration
 	// キャッシュするレスポンスの最大サイズ
 	BytesLimit int
+	// キャッシュキーにする URL の正規化（nil なら正規化しない）
+	KeyNormalize *KeyNormalizeConfig
+	// POST リクエストをリクエストボディ込みでキャッシュする（nil なら POST はキャッシュしない）
+	PostCache *PostCacheConfig
+	// 手動で固定したレスポンス（zunproxy cache pin）の一覧を読み直す間隔（デフォルトは 5s）
+	PinReloadInterval time.Duration
+	// クライアントに返す Cache-Control/Expires/Age をパス毎に書き換える（上から順に最初にマッチしたものを使う）
+	ClientTTL []ClientTTLRoute
+	// バックエンドの障害中は最後の正常なキャッシュを残し続ける（nil なら障害時のレスポンスで上書きする）
+	Grace *GraceConfig
+	// 過去のレスポンスを保持してロールバックできるようにする（nil なら保持しない）
+	Versions *VersionsConfig
+	// 200 で返ってきた壊れたレスポンスでキャッシュを上書きしないためのチェック（nil ならチェックしない）
+	Anomaly *AnomalyConfig
+	// ボディを BodyHash をキーにした別アイテムに保存する。ボディが変わらない更新はメタ情報だけ書き換え、同じボディは URL を跨いで共有する
+	BodyDedup bool
+	// キャッシュを作ったリクエストのキー元を追記していくファイル（cache export でキー一覧として使う）
+	// 追記するだけなので、大きくなったらその場で切り詰める（truncate -s 0。mv で退避すると退避した方に書き続ける）
+	KeyIndexFile string
+	// 何度かリクエストされたものだけキャッシュに保存する（nil なら常に保存する）
+	Admission *AdmissionConfig
+	// memcached に保存する値の暗号化（nil なら平文のまま保存する）
+	Encryption *CacheEncryptionConfig
+	// 別の設定でのヒット率などを本番の裏で評価する（nil なら評価しない）
+	Shadow *ShadowConfig
+}
+
+// AdaptiveWaitConfig キー毎の直近の応答時間の中央値(p50)を待ち時間にする設定
+type AdaptiveWaitConfig struct {
+	// 待ち時間の下限
+	Min time.Duration
+	// 待ち時間の上限。p50 がこれを超える遅いキーは待たずに古いキャッシュを返す
+	Max time.Duration
+	// p50 の計算に使う直近の応答時間の数（デフォルトは 10）
+	Samples int
 }
 
 func NewCacheHandler(config *CacheConfig) Middleware {
 	// レスポンスサイズの最大サイズのデフォルトは 700KB とする（memcachedのItemサイズの制限は1MB）
 	if config.BytesLimit <= 0 {
-		config.BytesLimit = 700_000_000
+		config.BytesLimit = 700_000
 	}
-	return &CacheHandler{
+	cache := &CacheHandler{
 		MemcachedClient: memcache.New(config.MemcachedServers...),
 		config:          config,
 	}
+	if config.Encryption != nil {
+		vc, err := newValueCipher(config.Encryption)
+		if err != nil {
+			panic(fmt.Errorf("invalid CacheConfig.Encryption: %w", err))
+		}
+		cache.cipher = vc
+	}
+	if config.KeyIndexFile != "" {
+		f, err := os.OpenFile(config.KeyIndexFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			panic(fmt.Errorf("could not open CacheConfig.KeyIndexFile: %w", err))
+		}
+		cache.keyIndex = f
+		cache.keyIndexSeen = map[string]struct{}{}
+	}
+	if config.MaxRefreshes > 0 {
+		cache.refreshes = make(chan struct{}, config.MaxRefreshes)
+	}
+	if config.KeyNormalize != nil {
+		cache.normalizer = newURLNormalizer(config.KeyNormalize)
+	}
+	if config.PostCache != nil {
+		cache.postCache = newPostCache(config.PostCache)
+	}
+	cache.clientTTL = newClientTTLRoutes(config.ClientTTL)
+	cache.pins = &cachePins{interval: config.PinReloadInterval}
+	if cache.pins.interval <= 0 {
+		cache.pins.interval = 5 * time.Second
+	}
+	if config.Versions != nil {
+		cache.versions = newCacheVersions(config.Versions, config.HardTTL)
+	}
+	if config.Anomaly != nil {
+		cache.anomaly = newAnomalyChecker(config.Anomaly)
+	}
+	if config.Admission != nil {
+		cache.admission = newAdmissionFilter(config.Admission)
+	}
+	if config.Shadow != nil {
+		cache.shadow = newCacheShadow(config.Shadow, cache)
+	}
+	return cache
 }
 
 type CacheHandler struct {
 	MemcachedClient *memcache.Client
 	config          *CacheConfig
+	cipher          *valueCipher
+	admission       *admissionFilter
+	normalizer      *urlNormalizer
+	postCache       *postCache
+	anomaly         *anomalyChecker
+	versions        *cacheVersions
+	clientTTL       []*clientTTLRoute
+	pins            *cachePins
+	shadow          *cacheShadow
+	// 実行中のバックグラウンド更新数を制限するセマフォ
+	refreshes chan struct{}
+	keyIndex  *os.File
+	keyIndexM sync.Mutex
+	// KeyIndexFile に書いた keySource（同じものを何度も追記しないように覚えておく）
+	keyIndexSeen map[string]struct{}
 }
 
 // キャッシュの情報
@@ -67,18 +170,42 @@ type CacheInfo struct {
 	Created time.Time
 	// ボディが更新された
 	Updated time.Time
+	// ボディの内容が変わった
+	BodyChanged time.Time
+	// memcached に保存した（HardTTL はここから数える）
+	Saved time.Time
 	// 更新回数（更新の度に +1 される）
 	UpCount int
 	// 総処理時間（更新の度にバックエンド処理に掛かった時間を足される）
 	UpDurations time.Duration
+	// 直近の更新でバックエンド処理に掛かった時間（AdaptiveWait.Samples 件まで）
+	RecentDurations []time.Duration `json:",omitempty"`
 	// ボディのハッシュ b64url(sha256(body))
 	BodyHash string
+	// ボディを別アイテムに保存している場合のキー（BodyDedup）
+	BodyKey string `json:",omitempty"`
+	// 過去のレスポンス（新しい順、Versions.Keep 世代まで）
+	Versions []CacheVersion `json:",omitempty"`
+	// ロールバック対象を選ぶためのタグ（Versions.Tags）
+	Tags []string `json:",omitempty"`
+	// この時刻までは更新せずに CachedResponse を返す（ロールバックなどで固定した場合）
+	PinnedUntil *time.Time `json:",omitempty"`
+	// バックエンドの障害で更新できなくなった（Grace）
+	OutageSince time.Time
+	// 直近の怪しいレスポンスのボディのハッシュと連続回数（Anomaly）
+	SuspectHash  string `json:",omitempty"`
+	SuspectCount int    `json:",omitempty"`
 	// キャッシュされたレスポンス
 	CachedResponse *CachedResponse
 	// 元になった Item を更新用に保持しておく
 	mcItem *memcache.Item
 }
 
+// isPinned ロールバックなどで固定されている間は true
+func (ci *CacheInfo) isPinned() bool {
+	return ci.PinnedUntil != nil && time.Now().Before(*ci.PinnedUntil)
+}
+
 func (ci *CacheInfo) Bytes() []byte {
 	bytes, err := json.Marshal(ci)
 	if err != nil {
@@ -92,7 +219,9 @@ type CachedResponse struct {
 	ContentLength int
 	Header        http.Header
 	Body          []byte
-	Enc           string
+	// 本文の後に送るトレイラー（Server-Timing やチェックサムなど）
+	Trailer http.Header `json:",omitempty"`
+	Enc     string
 	// 元になった Item を更新用に保持しておく
 	mcItem *memcache.Item
 }
@@ -131,11 +260,57 @@ func (cr *CachedResponse) WriteTo(w http.ResponseWriter) {
 	}
 	w.WriteHeader(cr.Code)
 	w.Write(cr.Body)
+	writeTrailer(w, cr.Trailer)
 }
 
 func (cache *CacheHandler) Handle(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ci, err := cache.getCacheInfo(r)
+		if isUpgradeRequest(r) {
+			// WebSocket などはキャッシュできないのでそのまま流す
+			next.ServeHTTP(w, r)
+			return
+		}
+		if cache.normalizer != nil {
+			if q, changed := cache.normalizer.UpstreamQuery(r.URL.RawQuery); changed {
+				// トラッキング用のパラメータなどはバックエンドにも送らない
+				r = r.Clone(r.Context())
+				r.URL.RawQuery = q
+			}
+		}
+		keySource := cache.keySource(r)
+		if pin := cache.pinnedFor(r, keySource); pin != nil {
+			// 手動で固定されたレスポンスは何よりも優先する
+			pin.Response.WriteTo(w)
+			return
+		}
+		liveOutcome := shadowPass
+		if cache.shadow != nil {
+			defer func() { cache.shadow.Observe(r, keySource, liveOutcome) }()
+		}
+		switch {
+		case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		case cache.postCache != nil && cache.postCache.Match(r):
+			bodyHash, ok, err := cache.postCache.BodyHash(r)
+			if err != nil || !ok {
+				if err != nil {
+					log.Print(err)
+				}
+				// ボディが読めない・大きすぎるものはキャッシュしない
+				next.ServeHTTP(w, r)
+				return
+			}
+			keySource += " body=" + bodyHash
+		default:
+			// 更新系のリクエストはキャッシュしない
+			next.ServeHTTP(w, r)
+			return
+		}
+		if isStreamingRequest(r) {
+			// SSE などはキャッシュできないしクライアントの切断でバックエンドも止めたいのでそのまま流す
+			next.ServeHTTP(w, r)
+			return
+		}
+		ci, err := cache.getCacheInfo(keySource)
 		if err != nil {
 			// memcached で何かエラー
 			log.Print(err)
@@ -143,96 +318,311 @@ func (cache *CacheHandler) Handle(next http.Handler) http.Handler {
 			next.ServeHTTP(w, r)
 			return
 		}
+		switch {
+		case ci.CachedResponse == nil:
+			liveOutcome = shadowMiss
+		case ci.isPinned() || time.Now().Before(ci.Expires):
+			liveOutcome = shadowHit
+		default:
+			liveOutcome = shadowStale
+		}
 		if ci.CachedResponse != nil {
+			if ci.isPinned() {
+				// ロールバックなどで固定されているので更新せずに返す
+				ci.CachedResponse.WriteTo(cache.clientWriter(w, r, ci.Updated))
+				return
+			}
 			if time.Now().Before(ci.Expires) {
 				// キャッシュが有効なのですぐ返して終了
-				ci.CachedResponse.WriteTo(w)
+				ci.CachedResponse.WriteTo(cache.clientWriter(w, r, ci.Updated))
 				return
 			}
 		}
 
+		if ci.CachedResponse == nil && cache.admission != nil && !cache.admission.Admit(r.URL.Path, ci.Key) {
+			// まだリクエスト回数が少ないのでキャッシュせずにスルー
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		// キャッシュ更新は確定
 		tsStart := time.Now()
 		var isNew bool
 		var rec ResponseRecorder
-		if ci.CachedResponse == nil {
+		oldResponse := ci.CachedResponse
+		oldUpdated := ci.Updated
+		if oldResponse == nil {
 			isNew = true
-			rec = NewResponseRecorder(w)
+			rec = NewResponseRecorder(cache.clientWriter(w, r, tsStart))
 		} else {
+			if !cache.acquireRefresh() {
+				// 更新が詰まっているので古いキャッシュを返すだけにする
+				oldResponse.WriteTo(cache.clientWriter(w, r, oldUpdated))
+				log.Printf("%v %v %10s %v %v >MaxRefreshes(%v)", "OLDRES", ci.Key, time.Since(tsStart).Truncate(time.Millisecond), oldResponse.Code, ci.KeySource, cache.config.MaxRefreshes)
+				return
+			}
 			isNew = false
 			rec = NewResponseSteeler()
 		}
+		// Response を取り出せるようにしておく（BytesLimit を超えたらその時点でバッファを捨てる）
+		lb := newLimitedBuffer(cache.config.BytesLimit)
+		rec.AddWriter(lb)
+		// クライアント向けに書き換える前のヘッダを保存する
+		var recHeader http.Header
+		// Content-Length で既にサイズ超過が分かっていれば最初からバッファしない
+		rec.AddWriteHeaderListener(func(code int, header http.Header) {
+			recHeader = header
+			if cl, err := strconv.Atoi(header.Get("Content-Length")); err == nil && lb.limit > 0 && lb.limit < cl {
+				lb.Discard()
+			}
+			// ストリーミングのレスポンスは終わりが無いのでキャッシュしない
+			if isStreamingResponse(header) {
+				lb.Discard()
+			}
+		})
 
+		// 更新の場合に新しいレスポンスを待つ時間は ci を更新する goroutine を起動する前に決めておく
+		var waitLimit time.Duration
+		if !isNew {
+			waitLimit = cache.newResponseWaitLimit(ci)
+		}
 		// バックエンドにリクエストを投げる
 		newCache := make(chan *CachedResponse, 1)
 		go func() {
+			if !isNew {
+				defer cache.releaseRefresh()
+			}
 			// 他リクエストが同時にキャッシュ更新するのを避けるためにまずキャッシュのExpiresを伸ばしておく
 			// 失敗しててもやることは変わらないので error は無視
 			_ = cache.updateCacheInfo(ci)
-			// Responseを取り出せるようにしておく
-			buf := bytes.NewBuffer([]byte{})
-			rec.AddWriter(buf)
-			//ついでにハッシュも計算しておく
-			hash := sha256.New()
-			rec.AddWriter(hash)
-			next.ServeHTTP(rec, r.Clone(context.Background()))
+			// クライアントが切断しても更新は続けるがバックエンドが詰まった時に備えて RefreshTimeout で打ち切る
+			// 新規の場合はクライアントにそのまま流しているので途中で打ち切らない
+			ctx := context.Background()
+			if !isNew && 0 < cache.config.RefreshTimeout {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, cache.config.RefreshTimeout)
+				defer cancel()
+			}
+			next.ServeHTTP(rec, cloneRequest(r, ctx))
+			if ctx.Err() != nil {
+				// 打ち切ったレスポンスは不完全なので保存しない（Expires は伸ばしてあるので暫くは古いキャッシュが使われる）
+				log.Printf("%v %v ttl=-    %10s %v %v >RefreshTimeout(%v)", "TIMEOUT", ci.Key, time.Since(tsStart).Truncate(time.Millisecond), rec.Code(), ci.KeySource, cache.config.RefreshTimeout)
+				cache.keepDuringOutage(ci, http.StatusGatewayTimeout)
+				newCache <- nil
+				return
+			}
+			if isBackendFailure(rec.Code()) && cache.keepDuringOutage(ci, rec.Code()) {
+				// 障害中は最後の正常なキャッシュを返し続ける
+				newCache <- nil
+				return
+			}
 			// HTTP Status Code をに応じたTTLがあればそれを使う
 			ttl, ok := cache.config.ErrorTTL[rec.Code()]
 			if !ok {
 				ttl = cache.config.SoftTTL
 			}
-			ci.CachedResponse = &CachedResponse{
-				Code:          rec.Code(),
-				ContentLength: rec.ContentLength(),
-				Header:        rec.Header().Clone(),
-				Body:          buf.Bytes(),
-			}
-			if cache.config.BytesLimit <= 0 || ci.CachedResponse.ContentLength <= cache.config.BytesLimit {
+			if !lb.Overflowed() {
 				// レスポンスサイズ問題なし
+				if recHeader == nil {
+					recHeader = rec.Header().Clone()
+				}
+				cr := &CachedResponse{
+					Code:          rec.Code(),
+					ContentLength: rec.ContentLength(),
+					Header:        recHeader,
+					Body:          lb.Bytes(),
+					Trailer:       rec.Trailer(),
+				}
+				if cache.anomaly != nil {
+					if reason := cache.anomaly.Check(r.URL.Path, ci.CachedResponse, cr); reason != "" && !cache.anomaly.Accept(ci, lb.Hash()) {
+						// 怪しいレスポンスはリクエスト元には返すがキャッシュは上書きしない
+						// 新規のキーでは守るべきレスポンスが無いので、空の CacheInfo を保存し直すことはしない
+						if ci.CachedResponse != nil {
+							_ = cache.updateCacheInfo(ci)
+						}
+						log.Printf("%v %v ttl=-    %10s %v %v %v (%v/%v)", "SUSPECT", ci.Key, time.Since(tsStart).Truncate(time.Millisecond), cr.Code, ci.KeySource, reason, ci.SuspectCount, cache.config.Anomaly.AcceptAfter)
+						newCache <- cr
+						return
+					}
+				}
+				ci.SuspectHash = ""
+				ci.SuspectCount = 0
+				if !isBackendFailure(cr.Code) {
+					cache.recoverFromOutage(ci)
+				}
+				if ci.BodyHash != lb.Hash() {
+					if cache.versions != nil && ci.CachedResponse != nil {
+						if err := cache.pushVersion(ci); err != nil {
+							log.Printf("could not save version: %v", err)
+						}
+					}
+					ci.BodyChanged = time.Now()
+				}
+				if cache.versions != nil {
+					ci.Tags = cache.versions.Tags(r.URL.Path)
+				}
+				ci.CachedResponse = cr
+				ci.BodyHash = lb.Hash()
 				ci.Updated = time.Now()
 				ci.UpDurations += time.Since(tsStart)
 				ci.UpCount++
-				err = cache.updateCacheInfoWithTTL(ci, ttl)
+				cache.addRecentDuration(ci, time.Since(tsStart))
+				err := cache.updateCacheInfoWithTTL(ci, ttl)
 				if err != nil {
 					log.Printf("could not save CacheInfo: %v", err)
+				} else if isNew {
+					cache.indexKey(ci.KeySource)
 				}
 				log.Printf("%v %v ttl=%-4s %10s %v %v", "UPDATE", ci.Key, ttl, time.Since(tsStart).Truncate(time.Millisecond), ci.CachedResponse.Code, ci.KeySource)
+				newCache <- ci.CachedResponse
 			} else {
 				// キャッシュサイズが大きい場合はキャッシュを削除
-				cache.MemcachedClient.Delete(ci.mcItem.Key)
-				if err != nil {
+				err := cache.MemcachedClient.Delete(ci.mcItem.Key)
+				if err != nil && err != memcache.ErrCacheMiss {
 					log.Printf("could not delete CacheInfo: %v", err)
 				}
-				log.Printf("%v %v ttl=-    %10s %v %v >BytesLimit(%v)", "DELBTLM", ci.Key, time.Since(tsStart).Truncate(time.Millisecond), ci.CachedResponse.Code, ci.KeySource, cache.config.BytesLimit)
+				log.Printf("%v %v ttl=-    %10s %v %v >BytesLimit(%v)", "DELBTLM", ci.Key, time.Since(tsStart).Truncate(time.Millisecond), rec.Code(), ci.KeySource, cache.config.BytesLimit)
+				// ボディは保持していないので新しいレスポンスは返せない
+				newCache <- nil
 			}
-			newCache <- ci.CachedResponse
 		}()
 
 		// 新規なら更新リクエストが終わったら戻る
 		if isNew {
 			<-newCache
-			log.Printf("%v %v ttl=-    %10s %v %v", "CREATE", ci.Key, time.Since(tsStart).Truncate(time.Millisecond), ci.CachedResponse.Code, ci.KeySource)
+			log.Printf("%v %v ttl=-    %10s %v %v", "CREATE", ci.Key, time.Since(tsStart).Truncate(time.Millisecond), rec.Code(), ci.KeySource)
 			return
 		}
 
 		// 更新の場合は、NewResponseWaitLimit 秒以内にバックエンドのレスポンスが帰ってこなければ古いキャッシュを返す
-		oldCache := make(chan *CachedResponse, 1)
-		go func() {
-			time.Sleep(cache.config.NewResponseWaitLimit)
-			oldCache <- ci.CachedResponse
-		}()
+		if waitLimit <= 0 {
+			// 待たない設定（遅いキー）は常に古いキャッシュを返す
+			oldResponse.WriteTo(cache.clientWriter(w, r, oldUpdated))
+			log.Printf("%v %v %10s %v %v", "OLDRES", ci.Key, time.Since(tsStart).Truncate(time.Millisecond), oldResponse.Code, ci.KeySource)
+			return
+		}
+		timer := time.NewTimer(waitLimit)
+		defer timer.Stop()
 		select {
-		case wt := <-oldCache:
-			wt.WriteTo(w)
-			log.Printf("%v %v %10s %v %v", "OLDRES", ci.Key, time.Since(tsStart).Truncate(time.Millisecond), ci.CachedResponse.Code, ci.KeySource)
+		case <-timer.C:
+			oldResponse.WriteTo(cache.clientWriter(w, r, oldUpdated))
+			log.Printf("%v %v %10s %v %v", "OLDRES", ci.Key, time.Since(tsStart).Truncate(time.Millisecond), oldResponse.Code, ci.KeySource)
 			return
 		case wt := <-newCache:
-			wt.WriteTo(w)
+			if wt == nil {
+				// 新しいレスポンスが返せない場合（BytesLimit 超過やバックエンドの障害）は古いキャッシュで応える
+				oldResponse.WriteTo(cache.clientWriter(w, r, oldUpdated))
+				return
+			}
+			wt.WriteTo(cache.clientWriter(w, r, time.Now()))
 			return
 		}
 	})
 }
 
+// acquireRefresh バックグラウンド更新の枠を確保する。MaxRefreshes に達していたら false を返す
+func (cache *CacheHandler) acquireRefresh() bool {
+	if cache.refreshes == nil {
+		return true
+	}
+	select {
+	case cache.refreshes <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseRefresh acquireRefresh で確保した枠を開放する
+func (cache *CacheHandler) releaseRefresh() {
+	if cache.refreshes != nil {
+		<-cache.refreshes
+	}
+}
+
+// newResponseWaitLimit 更新時にバックエンドの新しいレスポンスを待つ時間
+func (cache *CacheHandler) newResponseWaitLimit(ci *CacheInfo) time.Duration {
+	aw := cache.config.AdaptiveWait
+	if aw == nil || len(ci.RecentDurations) == 0 {
+		return cache.config.NewResponseWaitLimit
+	}
+	ds := append([]time.Duration{}, ci.RecentDurations...)
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	p50 := ds[len(ds)/2]
+	if 0 < aw.Max && aw.Max < p50 {
+		// 遅いキーは待っても間に合わない可能性が高いのですぐ古いキャッシュを返す
+		return 0
+	}
+	if p50 < aw.Min {
+		return aw.Min
+	}
+	return p50
+}
+
+// addRecentDuration 応答時間を記録して古いものは捨てる
+func (cache *CacheHandler) addRecentDuration(ci *CacheInfo, d time.Duration) {
+	aw := cache.config.AdaptiveWait
+	if aw == nil {
+		ci.RecentDurations = nil
+		return
+	}
+	samples := aw.Samples
+	if samples <= 0 {
+		samples = 10
+	}
+	ci.RecentDurations = append(ci.RecentDurations, d)
+	if over := len(ci.RecentDurations) - samples; 0 < over {
+		ci.RecentDurations = ci.RecentDurations[over:]
+	}
+}
+
+// limitedBuffer は limit バイトまでだけボディを保持する io.Writer
+// limit を超えた時点で保持していた内容を捨てて以降は読み捨てる（MultiWriter を止めないよう書き込みは常に成功扱い）
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	hash     hash.Hash
+	limit    int
+	overflow bool
+}
+
+func newLimitedBuffer(limit int) *limitedBuffer {
+	return &limitedBuffer{
+		hash:  sha256.New(),
+		limit: limit,
+	}
+}
+
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	if lb.overflow {
+		return len(p), nil
+	}
+	if lb.limit > 0 && lb.limit < lb.buf.Len()+len(p) {
+		lb.Discard()
+		return len(p), nil
+	}
+	lb.hash.Write(p)
+	return lb.buf.Write(p)
+}
+
+// Discard 保持しているボディを捨ててバッファリングを止める
+func (lb *limitedBuffer) Discard() {
+	lb.overflow = true
+	lb.buf = bytes.Buffer{}
+}
+
+func (lb *limitedBuffer) Overflowed() bool {
+	return lb.overflow
+}
+
+func (lb *limitedBuffer) Bytes() []byte {
+	return lb.buf.Bytes()
+}
+
+// Hash b64url(sha256(body))
+func (lb *limitedBuffer) Hash() string {
+	return Base64.EncodeToString(lb.hash.Sum(nil))
+}
+
 func (cache *CacheHandler) makeCacheKey(prefix string, key string) string {
 	hash := sha256.New()
 	hash.Write([]byte(key))
@@ -244,8 +634,21 @@ func (cache *CacheHandler) makeCacheKey(prefix string, key string) string {
 	return k
 }
 
-func (cache *CacheHandler) getCacheInfo(r *http.Request) (*CacheInfo, error) {
-	rKeySource := r.Method + " " + r.Host + r.URL.Path + "?" + r.URL.RawQuery
+// KeySource キャッシュキーの元になるリクエストを表す文字列（POST のボディは含まない）
+func (cache *CacheHandler) KeySource(r *http.Request) string {
+	return cache.keySource(r)
+}
+
+// keySource キャッシュキーの元になるリクエストを表す文字列
+func (cache *CacheHandler) keySource(r *http.Request) string {
+	if cache.normalizer == nil {
+		return r.Method + " " + r.Host + r.URL.Path + "?" + r.URL.RawQuery
+	}
+	un := cache.normalizer
+	return r.Method + " " + un.Host(r.Host, r.TLS != nil) + un.Path(r.URL) + "?" + un.Query(r.URL.RawQuery)
+}
+
+func (cache *CacheHandler) getCacheInfo(rKeySource string) (*CacheInfo, error) {
 	rKey := cache.makeCacheKey("ch/", rKeySource)
 	item, err := cache.MemcachedClient.Get(rKey)
 	if err != nil {
@@ -255,12 +658,30 @@ func (cache *CacheHandler) getCacheInfo(r *http.Request) (*CacheInfo, error) {
 	}
 	var ci CacheInfo
 	if item != nil {
-		ci.mcItem = item
-		err = json.Unmarshal(item.Value, &ci)
+		value, err := cache.decodeValue(item.Key, item.Value)
 		if err != nil {
-			return nil, fmt.Errorf("could not Unmarchal CacheInfo: %v", err)
+			// 復号できない値は改竄などの可能性があるので使わずにキャッシュミス扱いにする
+			log.Printf("%v %v %v", "BADVAL", rKey, err)
+			item = nil
+		} else {
+			ci.mcItem = item
+			err = json.Unmarshal(value, &ci)
+			if err != nil {
+				return nil, fmt.Errorf("could not Unmarchal CacheInfo: %v", err)
+			}
+			if ci.BodyKey != "" && ci.CachedResponse != nil && ci.CachedResponse.Body == nil {
+				body, err := cache.loadBody(&ci)
+				if err != nil {
+					// ボディが無いキャッシュは使えないので作り直す
+					log.Printf("%v %v %v", "BADBODY", rKey, err)
+					ci.CachedResponse = nil
+				} else {
+					ci.CachedResponse.Body = body
+				}
+			}
 		}
-	} else {
+	}
+	if item == nil {
 		ci = CacheInfo{
 			KeySource: rKeySource,
 			Key:       rKey,
@@ -276,12 +697,51 @@ func (cache *CacheHandler) updateCacheInfo(ci *CacheInfo) error {
 }
 
 func (cache *CacheHandler) updateCacheInfoWithTTL(ci *CacheInfo, ttl time.Duration) error {
-	ci.Expires = time.Now().Add(ttl)
-	ci.mcItem.Expiration = int32(cache.config.HardTTL.Seconds())
-	ciBytes, err := json.Marshal(ci)
+	ci.Saved = time.Now()
+	ci.Expires = ci.Saved.Add(ttl)
+	return cache.saveCacheInfo(ci, cache.config.HardTTL)
+}
+
+// saveCacheInfo ci を expiration の間だけ memcached に保存する
+func (cache *CacheHandler) saveCacheInfo(ci *CacheInfo, expiration time.Duration) error {
+	ci.mcItem.Expiration = int32(expiration.Seconds())
+	stored := ci
+	if cache.config.BodyDedup && ci.CachedResponse != nil && len(ci.CachedResponse.Body) != 0 {
+		if err := cache.saveBody(ci, expiration); err != nil {
+			return err
+		}
+		// ボディを抜いたメタ情報だけを保存する
+		meta := *ci
+		cr := *ci.CachedResponse
+		cr.Body = nil
+		meta.CachedResponse = &cr
+		stored = &meta
+	} else {
+		ci.BodyKey = ""
+	}
+	ciBytes, err := json.Marshal(stored)
 	if err != nil {
 		return fmt.Errorf("could not marshal CacheInfo: %v", err)
 	}
-	ci.mcItem.Value = ciBytes
+	ci.mcItem.Value, err = cache.encodeValue(ci.mcItem.Key, ciBytes)
+	if err != nil {
+		return err
+	}
 	return cache.MemcachedClient.Set(ci.mcItem)
 }
+
+// encodeValue memcached に保存する値に変換する（暗号化が有効なら暗号化する）
+func (cache *CacheHandler) encodeValue(mcKey string, value []byte) ([]byte, error) {
+	if cache.cipher == nil {
+		return value, nil
+	}
+	return cache.cipher.Seal(mcKey, value)
+}
+
+// decodeValue memcached から取り出した値を元に戻す（暗号化が有効なら復号と認証をする）
+func (cache *CacheHandler) decodeValue(mcKey string, value []byte) ([]byte, error) {
+	if cache.cipher == nil {
+		return value, nil
+	}
+	return cache.cipher.Open(mcKey, value)
+}
@@ -0,0 +1,390 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimitedBuffer(t *testing.T) {
+	tests := []struct {
+		name         string
+		limit        int
+		chunks       []string
+		wantOverflow bool
+		wantBody     string
+	}{
+		{
+			name:     "under limit",
+			limit:    10,
+			chunks:   []string{"abc", "def"},
+			wantBody: "abcdef",
+		},
+		{
+			name:     "just limit",
+			limit:    6,
+			chunks:   []string{"abc", "def"},
+			wantBody: "abcdef",
+		},
+		{
+			name:         "over limit",
+			limit:        5,
+			chunks:       []string{"abc", "def", "ghi"},
+			wantOverflow: true,
+			wantBody:     "",
+		},
+		{
+			name:     "no limit",
+			limit:    0,
+			chunks:   []string{strings.Repeat("x", 1000)},
+			wantBody: strings.Repeat("x", 1000),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newLimitedBuffer(tt.limit)
+			for _, c := range tt.chunks {
+				n, err := lb.Write([]byte(c))
+				if n != len(c) || err != nil {
+					t.Errorf("Write(%q) = %v, %v", c, n, err)
+				}
+			}
+			if lb.Overflowed() != tt.wantOverflow {
+				t.Errorf("Overflowed() = %v, want %v", lb.Overflowed(), tt.wantOverflow)
+			}
+			if string(lb.Bytes()) != tt.wantBody {
+				t.Errorf("Bytes() = %q, want %q", lb.Bytes(), tt.wantBody)
+			}
+			if !tt.wantOverflow {
+				sum := sha256.Sum256([]byte(tt.wantBody))
+				if want := Base64.EncodeToString(sum[:]); lb.Hash() != want {
+					t.Errorf("Hash() = %v, want %v", lb.Hash(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestLimitedBuffer_StreamsToClient(t *testing.T) {
+	body := strings.Repeat("0123456789", 100)
+	w := httptest.NewRecorder()
+	rec := NewResponseRecorder(w)
+	lb := newLimitedBuffer(100)
+	rec.AddWriter(lb)
+	rec.WriteHeader(http.StatusOK)
+	for i := 0; i < len(body); i += 10 {
+		rec.Write([]byte(body[i : i+10]))
+	}
+	if w.Body.String() != body {
+		t.Errorf("client body length = %v, want %v", w.Body.Len(), len(body))
+	}
+	if !lb.Overflowed() || len(lb.Bytes()) != 0 {
+		t.Errorf("buffer should be discarded: overflow=%v len=%v", lb.Overflowed(), len(lb.Bytes()))
+	}
+	if rec.ContentLength() != len(body) {
+		t.Errorf("ContentLength() = %v, want %v", rec.ContentLength(), len(body))
+	}
+}
+
+func TestCacheHandler_newResponseWaitLimit(t *testing.T) {
+	ms := func(ns ...int) []time.Duration {
+		var ds []time.Duration
+		for _, n := range ns {
+			ds = append(ds, time.Duration(n)*time.Millisecond)
+		}
+		return ds
+	}
+	aw := &AdaptiveWaitConfig{Min: 5 * time.Millisecond, Max: 100 * time.Millisecond}
+	tests := []struct {
+		name      string
+		aw        *AdaptiveWaitConfig
+		durations []time.Duration
+		want      time.Duration
+	}{
+		{"disabled", nil, ms(50), 20 * time.Millisecond},
+		{"no samples", aw, nil, 20 * time.Millisecond},
+		{"p50", aw, ms(30, 10, 500, 40, 20), 30 * time.Millisecond},
+		{"lower bound", aw, ms(1, 2, 3), 5 * time.Millisecond},
+		{"slow endpoint", aw, ms(200, 300, 10), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := &CacheHandler{config: &CacheConfig{NewResponseWaitLimit: 20 * time.Millisecond, AdaptiveWait: tt.aw}}
+			got := cache.newResponseWaitLimit(&CacheInfo{RecentDurations: tt.durations})
+			if got != tt.want {
+				t.Errorf("newResponseWaitLimit() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheHandler_addRecentDuration(t *testing.T) {
+	cache := &CacheHandler{config: &CacheConfig{AdaptiveWait: &AdaptiveWaitConfig{Samples: 3}}}
+	ci := &CacheInfo{}
+	for i := 1; i <= 5; i++ {
+		cache.addRecentDuration(ci, time.Duration(i))
+	}
+	want := []time.Duration{3, 4, 5}
+	if !reflect.DeepEqual(ci.RecentDurations, want) {
+		t.Errorf("RecentDurations = %v, want %v", ci.RecentDurations, want)
+	}
+}
+
+// expireCacheInfo キャッシュを SoftTTL 切れの状態にする（edit で他の値も書き換える）
+func expireCacheInfo(t *testing.T, cache *CacheHandler, keySource string, edit func(ci *CacheInfo)) {
+	t.Helper()
+	ci, err := cache.getCacheInfo(keySource)
+	if err != nil || ci.CachedResponse == nil {
+		t.Fatalf("getCacheInfo(%q) = %v, %v", keySource, ci, err)
+	}
+	ci.Expires = time.Now().Add(-time.Second)
+	if edit != nil {
+		edit(ci)
+	}
+	if err := cache.saveCacheInfo(ci, cache.config.HardTTL); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitCacheUpdated バックグラウンドの更新で ci.Updated が since より後になるまで待つ
+func waitCacheUpdated(t *testing.T, cache *CacheHandler, keySource string, since time.Time) *CacheInfo {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if ci, _ := cache.getCacheInfo(keySource); ci != nil && ci.Updated.After(since) {
+			return ci
+		}
+	}
+	t.Fatalf("cache %q is not updated", keySource)
+	return nil
+}
+
+func TestCacheHandler_AdaptiveWaitSlowKey(t *testing.T) {
+	fm := newFakeMemcached(t)
+	var n int32
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strconv.Itoa(int(atomic.AddInt32(&n, 1)))))
+	})
+	cache := NewCacheHandler(&CacheConfig{
+		MemcachedServers:     []string{fm.Addr()},
+		SoftTTL:              time.Minute,
+		HardTTL:              time.Hour,
+		NewResponseWaitLimit: time.Second,
+		AdaptiveWait:         &AdaptiveWaitConfig{Max: 100 * time.Millisecond},
+	}).(*CacheHandler)
+	h := cache.Handle(backend)
+	keySource := "GET example.com/?"
+	get := func() string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+		return rec.Body.String()
+	}
+	get()
+	// 遅いキーはバックエンドがすぐ返せても待たずに常に古いキャッシュを返す
+	for i := 0; i < 10; i++ {
+		ci, _ := cache.getCacheInfo(keySource)
+		want := string(ci.CachedResponse.Body)
+		since := ci.Updated
+		expireCacheInfo(t, cache, keySource, func(ci *CacheInfo) {
+			ci.RecentDurations = []time.Duration{time.Second, time.Second, time.Second}
+		})
+		if got := get(); got != want {
+			t.Fatalf("#%v response = %q, want old %q", i, got, want)
+		}
+		waitCacheUpdated(t, cache, keySource, since)
+	}
+}
+
+func TestCacheHandler_keySource(t *testing.T) {
+	cache := &CacheHandler{config: &CacheConfig{}, normalizer: newURLNormalizer(&KeyNormalizeConfig{DropQuery: []string{"utm_*"}})}
+	r1 := httptest.NewRequest("GET", "http://Example.com:80/a/./b?b=1&a=2&utm_source=x", nil)
+	r2 := httptest.NewRequest("GET", "http://example.com/a/b?a=2&b=1", nil)
+	if k1, k2 := cache.keySource(r1), cache.keySource(r2); k1 != k2 {
+		t.Errorf("keySource() = %v and %v, want same", k1, k2)
+	}
+	raw := &CacheHandler{config: &CacheConfig{}}
+	if got, want := raw.keySource(r1), "GET Example.com:80/a/./b?b=1&a=2&utm_source=x"; got != want {
+		t.Errorf("keySource() = %v, want %v", got, want)
+	}
+}
+
+func TestCacheHandler_acquireRefresh(t *testing.T) {
+	unlimited := &CacheHandler{config: &CacheConfig{}}
+	for i := 0; i < 100; i++ {
+		if !unlimited.acquireRefresh() {
+			t.Fatalf("acquireRefresh() = false without MaxRefreshes")
+		}
+	}
+	cache := NewCacheHandler(&CacheConfig{MaxRefreshes: 2}).(*CacheHandler)
+	got := []bool{cache.acquireRefresh(), cache.acquireRefresh(), cache.acquireRefresh()}
+	if want := []bool{true, true, false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("acquireRefresh() = %v, want %v", got, want)
+	}
+	cache.releaseRefresh()
+	if !cache.acquireRefresh() {
+		t.Errorf("acquireRefresh() after release = false")
+	}
+}
+
+func TestCacheHandler_RefreshTimeout(t *testing.T) {
+	fm := newFakeMemcached(t)
+	var block int32
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&block) == 1 {
+			// 詰まったバックエンドは RefreshTimeout で打ち切られるまで返さない
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("old"))
+	})
+	cache := NewCacheHandler(&CacheConfig{
+		MemcachedServers:     []string{fm.Addr()},
+		SoftTTL:              time.Minute,
+		HardTTL:              time.Hour,
+		NewResponseWaitLimit: 10 * time.Millisecond,
+		RefreshTimeout:       50 * time.Millisecond,
+		MaxRefreshes:         1,
+	}).(*CacheHandler)
+	h := cache.Handle(backend)
+	keySource := "GET example.com/?"
+	get := func() string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+		return rec.Body.String()
+	}
+	get()
+	atomic.StoreInt32(&block, 1)
+	expireCacheInfo(t, cache, keySource, nil)
+	if got := get(); got != "old" {
+		t.Fatalf("response while refreshing = %q, want old", got)
+	}
+	// 打ち切られたら枠が開放される
+	for deadline := time.Now().Add(time.Second); len(cache.refreshes) != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("refresh slot is not released after RefreshTimeout")
+		}
+	}
+	ci, _ := cache.getCacheInfo(keySource)
+	if ci.CachedResponse == nil || string(ci.CachedResponse.Body) != "old" {
+		t.Errorf("cached response = %v, want old", ci.CachedResponse)
+	}
+	// 枠が空いたので次の更新もできる
+	if !cache.acquireRefresh() {
+		t.Errorf("acquireRefresh() after RefreshTimeout = false")
+	}
+	cache.releaseRefresh()
+}
+
+func TestCacheHandler_RefreshTimeoutFirstFill(t *testing.T) {
+	fm := newFakeMemcached(t)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// RefreshTimeout より遅い最初のレスポンス
+		w.Write([]byte("slow "))
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte("first"))
+	})
+	cache := NewCacheHandler(&CacheConfig{
+		MemcachedServers:     []string{fm.Addr()},
+		SoftTTL:              time.Minute,
+		HardTTL:              time.Hour,
+		NewResponseWaitLimit: 10 * time.Millisecond,
+		RefreshTimeout:       20 * time.Millisecond,
+	}).(*CacheHandler)
+	rec := httptest.NewRecorder()
+	cache.Handle(backend).ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+	// 新規のキャッシュ作成は RefreshTimeout で打ち切らない
+	if got := rec.Body.String(); got != "slow first" {
+		t.Errorf("first fill body = %q, want %q", got, "slow first")
+	}
+	ci, _ := cache.getCacheInfo("GET example.com/?")
+	if ci.CachedResponse == nil || string(ci.CachedResponse.Body) != "slow first" {
+		t.Errorf("cached response = %v, want slow first", ci.CachedResponse)
+	}
+}
+
+func TestCacheHandler_Streaming(t *testing.T) {
+	fm := newFakeMemcached(t)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+	})
+	cache := NewCacheHandler(&CacheConfig{
+		MemcachedServers:     []string{fm.Addr()},
+		SoftTTL:              time.Minute,
+		HardTTL:              time.Hour,
+		NewResponseWaitLimit: time.Second,
+	}).(*CacheHandler)
+	h := cache.Handle(backend)
+
+	// SSE のリクエストは memcached を見ずにそのまま流す
+	r := httptest.NewRequest("GET", "http://example.com/events", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if !rec.Flushed || rec.Body.String() != "data: 1\n\n" || fm.Count("get") != 0 {
+		t.Errorf("Flushed = %v, body = %q, get = %v", rec.Flushed, rec.Body.String(), fm.Count("get"))
+	}
+	// Accept が無くてもストリーミングのレスポンスはキャッシュしない
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/events", nil))
+	if !rec.Flushed {
+		t.Errorf("response is not flushed")
+	}
+	if ci, _ := cache.getCacheInfo("GET example.com/events?"); ci.CachedResponse != nil {
+		t.Errorf("streaming response is cached")
+	}
+}
+
+func TestCacheHandler_Trailer(t *testing.T) {
+	fm := newFakeMemcached(t)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Trailer", "Server-Timing")
+		w.Write([]byte("<html></html>"))
+		w.Header().Set("Server-Timing", "app;dur=12")
+		w.Header().Set(http.TrailerPrefix+"X-Checksum", "abc")
+	})
+	cache := NewCacheHandler(&CacheConfig{
+		MemcachedServers:     []string{fm.Addr()},
+		SoftTTL:              time.Minute,
+		HardTTL:              time.Hour,
+		NewResponseWaitLimit: time.Second,
+	})
+	ts := httptest.NewServer(MultipleHandler(backend, NewRequestBundler(nil), cache, NewBrokenRewriteGuard()))
+	defer ts.Close()
+
+	// 1回目はバックエンドから、2回目はキャッシュから
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "<html></html>" {
+			t.Errorf("#%v body = %q", i, body)
+		}
+		if resp.Trailer.Get("Server-Timing") != "app;dur=12" || resp.Trailer.Get("X-Checksum") != "abc" {
+			t.Errorf("#%v Trailer = %v", i, resp.Trailer)
+		}
+		if resp.Header.Get("Server-Timing") != "" {
+			t.Errorf("#%v trailer is sent as header", i)
+		}
+	}
+	ci, _ := cache.(*CacheHandler).getCacheInfo("GET " + strings.TrimPrefix(ts.URL, "http://") + "/?")
+	if ci.CachedResponse == nil || ci.CachedResponse.Trailer.Get("Server-Timing") != "app;dur=12" {
+		t.Errorf("cached trailer = %v", ci.CachedResponse)
+	}
+}
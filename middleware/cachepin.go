@@ -0,0 +1,300 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/goccy/go-json"
+)
+
+// 固定レスポンスの索引を保存する memcached のキー（レスポンス自体は固定毎に別のアイテムに保存する）
+const pinsKey = "cp/pins"
+
+// 固定レスポンスのアイテムのキーのプレフィックス
+const pinKeyPrefix = "cp/"
+
+// CachePin 障害対応などで手動で固定したレスポンス。TTL やバックエンドでの更新を無視して外されるまで返し続ける
+type CachePin struct {
+	// Request を表す文字列
+	KeySource string
+	// 固定した URL
+	URL string
+	// 固定した時刻
+	Created time.Time
+	// この時刻を過ぎたら固定を外す（ゼロなら外されるまで固定）
+	Until time.Time
+	// 返すレスポンス
+	Response *CachedResponse
+}
+
+// pinIndexEntry 索引には固定レスポンスのアイテムのキーと期限だけを持つ
+type pinIndexEntry struct {
+	Key   string
+	Until time.Time
+}
+
+// cachePins は全プロセスで共有する固定レスポンスの一覧を memcached から定期的に読み込んで持っておく
+// pins は差し替えるだけで書き換えないのでロックを外した後も参照できる
+type cachePins struct {
+	interval time.Duration
+	loaded   time.Time
+	loading  bool
+	pins     map[string]*CachePin
+	m        sync.Mutex
+}
+
+// pinned keySource に固定レスポンスがあれば返す
+// 一覧の読み込みはバックグラウンドで行うのでリクエストが memcached を待つことはない
+func (cache *CacheHandler) pinned(keySource string) *CachePin {
+	ps := cache.pins
+	ps.m.Lock()
+	reload := !ps.loading && ps.interval < time.Since(ps.loaded)
+	if reload {
+		ps.loading = true
+	}
+	pins := ps.pins
+	ps.m.Unlock()
+	if reload {
+		go cache.reloadPins()
+	}
+	pin := pins[keySource]
+	if pin == nil || (!pin.Until.IsZero() && time.Now().After(pin.Until)) {
+		return nil
+	}
+	return pin
+}
+
+// pinnedFor r の固定レスポンスがあれば返す。固定は GET で登録するので HEAD には GET の固定レスポンスを使う
+func (cache *CacheHandler) pinnedFor(r *http.Request, keySource string) *CachePin {
+	pin := cache.pinned(keySource)
+	if pin == nil && r.Method == http.MethodHead {
+		get := r.Clone(r.Context())
+		get.Method = http.MethodGet
+		pin = cache.pinned(cache.keySource(get))
+	}
+	return pin
+}
+
+// reloadPins memcached から固定レスポンスの一覧を読み直す
+func (cache *CacheHandler) reloadPins() {
+	pins, err := cache.loadPins()
+	if err != nil {
+		log.Printf("could not load pins: %v", err)
+	}
+	ps := cache.pins
+	ps.m.Lock()
+	defer ps.m.Unlock()
+	if err == nil {
+		ps.pins = pins
+	}
+	// 読み込みに失敗しても毎リクエスト memcached に問い合わせないように時刻は更新する
+	ps.loaded = time.Now()
+	ps.loading = false
+}
+
+// updateLocalPins 自分の書き換えを読み込み直すのを待たずに反映させる
+func (cache *CacheHandler) updateLocalPins(f func(pins map[string]*CachePin)) {
+	ps := cache.pins
+	ps.m.Lock()
+	defer ps.m.Unlock()
+	pins := make(map[string]*CachePin, len(ps.pins)+1)
+	for ks, pin := range ps.pins {
+		pins[ks] = pin
+	}
+	f(pins)
+	ps.pins = pins
+}
+
+// loadPins 索引にある固定レスポンスを全て読み込む（期限切れや追い出されたものは除く）
+func (cache *CacheHandler) loadPins() (map[string]*CachePin, error) {
+	index, _, err := cache.loadPinIndex()
+	if err != nil {
+		return nil, err
+	}
+	pins := map[string]*CachePin{}
+	if len(index) == 0 {
+		return pins, nil
+	}
+	var keys []string
+	for _, e := range index {
+		keys = append(keys, e.Key)
+	}
+	items, err := cache.MemcachedClient.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	for ks, e := range index {
+		item := items[e.Key]
+		if item == nil {
+			continue
+		}
+		value, err := cache.decodeValue(item.Key, item.Value)
+		if err != nil {
+			log.Printf("%v %v %v", "BADVAL", item.Key, err)
+			continue
+		}
+		var pin CachePin
+		if err := json.Unmarshal(value, &pin); err != nil {
+			return nil, fmt.Errorf("could not unmarshal pin %v: %v", item.Key, err)
+		}
+		if pin.KeySource == ks {
+			pins[ks] = &pin
+		}
+	}
+	return pins, nil
+}
+
+func (cache *CacheHandler) loadPinIndex() (map[string]*pinIndexEntry, *memcache.Item, error) {
+	index := map[string]*pinIndexEntry{}
+	item, err := cache.MemcachedClient.Get(pinsKey)
+	if err == memcache.ErrCacheMiss {
+		return index, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	value, err := cache.decodeValue(item.Key, item.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(value, &index); err != nil {
+		return nil, nil, fmt.Errorf("could not unmarshal pins: %v", err)
+	}
+	return index, item, nil
+}
+
+// updatePinIndex 固定レスポンスの索引を f で書き換えて保存する（他プロセスと同時に書き換えた場合はやり直す）
+func (cache *CacheHandler) updatePinIndex(f func(index map[string]*pinIndexEntry) bool) (bool, error) {
+	for retry := 0; retry < 10; retry++ {
+		index, item, err := cache.loadPinIndex()
+		if err != nil {
+			return false, err
+		}
+		now := time.Now()
+		for ks, e := range index {
+			if !e.Until.IsZero() && now.After(e.Until) {
+				delete(index, ks)
+			}
+		}
+		if !f(index) {
+			return false, nil
+		}
+		b, err := json.Marshal(index)
+		if err != nil {
+			return false, fmt.Errorf("could not marshal pins: %v", err)
+		}
+		value, err := cache.encodeValue(pinsKey, b)
+		if err != nil {
+			return false, err
+		}
+		if item == nil {
+			err = cache.MemcachedClient.Add(&memcache.Item{Key: pinsKey, Value: value})
+		} else {
+			item.Value = value
+			err = cache.MemcachedClient.CompareAndSwap(item)
+		}
+		if err == memcache.ErrNotStored || err == memcache.ErrCASConflict {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("could not save pins: %v", err)
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("could not save pins: too many conflicts")
+}
+
+// pinExpiration 固定レスポンスのアイテムの有効期限（固定が外れたら memcached からも消えるようにする）
+func pinExpiration(until time.Time) int32 {
+	if until.IsZero() {
+		return 0
+	}
+	d := time.Until(until) + time.Second
+	if d < time.Second {
+		d = time.Second
+	}
+	if 30*24*time.Hour < d {
+		// memcached は 30 日を超える値を UNIX 時刻とみなす
+		return int32(until.Unix() + 1)
+	}
+	return int32(d.Seconds())
+}
+
+// Pin r のリクエストに cr を返すように固定する。until がゼロなら Unpin されるまで固定する
+func (cache *CacheHandler) Pin(r *http.Request, cr *CachedResponse, until time.Time) error {
+	pin := &CachePin{
+		KeySource: cache.keySource(r),
+		URL:       r.URL.String(),
+		Created:   time.Now(),
+		Until:     until,
+		Response:  cr,
+	}
+	key := cache.makeCacheKey(pinKeyPrefix, pin.KeySource)
+	b, err := json.Marshal(pin)
+	if err != nil {
+		return fmt.Errorf("could not marshal pin: %v", err)
+	}
+	value, err := cache.encodeValue(key, b)
+	if err != nil {
+		return err
+	}
+	if err := cache.MemcachedClient.Set(&memcache.Item{Key: key, Value: value, Expiration: pinExpiration(until)}); err != nil {
+		return fmt.Errorf("could not save pin %v: %v", key, err)
+	}
+	_, err = cache.updatePinIndex(func(index map[string]*pinIndexEntry) bool {
+		index[pin.KeySource] = &pinIndexEntry{Key: key, Until: until}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	cache.updateLocalPins(func(pins map[string]*CachePin) { pins[pin.KeySource] = pin })
+	log.Printf("%v %v %v %v", "PIN", pin.Response.Code, pin.KeySource, pin.Until.Format(time.RFC3339))
+	return nil
+}
+
+// Unpin r のリクエストの固定を外す。固定されていなかったら false を返す
+func (cache *CacheHandler) Unpin(r *http.Request) (bool, error) {
+	keySource := cache.keySource(r)
+	var key string
+	ok, err := cache.updatePinIndex(func(index map[string]*pinIndexEntry) bool {
+		e, found := index[keySource]
+		if !found {
+			return false
+		}
+		key = e.Key
+		delete(index, keySource)
+		return true
+	})
+	if !ok || err != nil {
+		return ok, err
+	}
+	if err := cache.MemcachedClient.Delete(key); err != nil && err != memcache.ErrCacheMiss {
+		log.Printf("could not delete pin %v: %v", key, err)
+	}
+	cache.updateLocalPins(func(pins map[string]*CachePin) { delete(pins, keySource) })
+	log.Printf("%v %v", "UNPIN", keySource)
+	return true, nil
+}
+
+// Pins 今の固定レスポンスの一覧（固定した順）
+func (cache *CacheHandler) Pins() ([]*CachePin, error) {
+	pins, err := cache.loadPins()
+	if err != nil {
+		return nil, err
+	}
+	var list []*CachePin
+	now := time.Now()
+	for _, pin := range pins {
+		if pin.Until.IsZero() || now.Before(pin.Until) {
+			list = append(list, pin)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list, nil
+}
@@ -0,0 +1,176 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheHandler_Pin(t *testing.T) {
+	fm := newFakeMemcached(t)
+	var backendCount int32
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&backendCount, 1)
+		w.Write([]byte("backend"))
+	})
+	cache := NewCacheHandler(&CacheConfig{
+		MemcachedServers:     []string{fm.Addr()},
+		SoftTTL:              time.Minute,
+		HardTTL:              time.Hour,
+		NewResponseWaitLimit: time.Second,
+	}).(*CacheHandler)
+	h := cache.Handle(backend)
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		return rec
+	}
+	if got := get("http://example.com/a").Body.String(); got != "backend" {
+		t.Fatalf("body = %q", got)
+	}
+
+	target := httptest.NewRequest("GET", "http://example.com/a", nil)
+	header := http.Header{"Content-Type": {"text/plain"}}
+	if err := cache.Pin(target, NewPinnedResponse(http.StatusServiceUnavailable, header, []byte("maintenance")), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	before := atomic.LoadInt32(&backendCount)
+	rec := get("http://example.com/a")
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "maintenance" || rec.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("pinned response = %v %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+	// HEAD にも GET の固定レスポンスを返す
+	head := httptest.NewRecorder()
+	h.ServeHTTP(head, httptest.NewRequest("HEAD", "http://example.com/a", nil))
+	if head.Code != http.StatusServiceUnavailable || head.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("pinned response to HEAD = %v %v", head.Code, head.Header())
+	}
+	if atomic.LoadInt32(&backendCount) != before {
+		t.Errorf("backend is called for pinned request")
+	}
+	// 他の URL には影響しない
+	if got := get("http://example.com/b").Body.String(); got != "backend" {
+		t.Errorf("body of unpinned url = %q", got)
+	}
+
+	// 別プロセスからも見える
+	other := NewCacheHandler(&CacheConfig{MemcachedServers: []string{fm.Addr()}}).(*CacheHandler)
+	pins, err := other.Pins()
+	if err != nil || len(pins) != 1 || pins[0].KeySource != "GET example.com/a?" {
+		t.Fatalf("Pins() = %v, %v", pins, err)
+	}
+	// 一覧はバックグラウンドで読み込まれる
+	for deadline := time.Now().Add(time.Second); other.pinned("GET example.com/a?") == nil; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("pin is not loaded by other handler")
+		}
+	}
+	// 索引にはレスポンスを持たず、固定毎に別のアイテムに保存する
+	if index, _, _ := cache.loadPinIndex(); len(index) != 1 {
+		t.Errorf("pin index = %v", index)
+	}
+	if key := cache.makeCacheKey(pinKeyPrefix, "GET example.com/a?"); !fm.Expires(key).IsZero() {
+		t.Errorf("expiration of unlimited pin = %v", fm.Expires(key))
+	}
+
+	ok, err := cache.Unpin(target)
+	if !ok || err != nil {
+		t.Fatalf("Unpin() = %v, %v", ok, err)
+	}
+	if got := get("http://example.com/a").Body.String(); got != "backend" {
+		t.Errorf("body after unpin = %q", got)
+	}
+	if ok, _ := cache.Unpin(target); ok {
+		t.Errorf("Unpin() of unpinned url = true")
+	}
+
+	// 期限付き
+	if err := cache.Pin(target, NewPinnedResponse(http.StatusOK, nil, []byte("pinned")), time.Now().Add(50*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if got := get("http://example.com/a").Body.String(); got != "pinned" {
+		t.Errorf("body before until = %q", got)
+	}
+	if exp := time.Until(fm.Expires(cache.makeCacheKey(pinKeyPrefix, "GET example.com/a?"))); exp <= 0 || 2*time.Second < exp {
+		t.Errorf("expiration of pin item = %v, want until", exp)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if got := get("http://example.com/a").Body.String(); got != "backend" {
+		t.Errorf("body after until = %q", got)
+	}
+	if pins, _ := cache.Pins(); len(pins) != 0 {
+		t.Errorf("expired pins are listed: %v", pins)
+	}
+}
+
+func TestCacheAdminHandler(t *testing.T) {
+	fm := newFakeMemcached(t)
+	cache := NewCacheHandler(&CacheConfig{MemcachedServers: []string{fm.Addr()}, BytesLimit: 100}).(*CacheHandler)
+	admin := NewCacheAdminHandler(cache)
+	do := func(method, target string, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "text/html")
+		admin.ServeHTTP(rec, r)
+		return rec
+	}
+	rec := do("PUT", "/cache/pins?url=http://example.com/a&code=503&header=Retry-After:+60", "<p>maintenance</p>")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT = %v %v", rec.Code, rec.Body.String())
+	}
+	pin := cache.pinned("GET example.com/a?")
+	if pin == nil {
+		t.Fatal("not pinned")
+	}
+	if cr := pin.Response; cr.Code != 503 || string(cr.Body) != "<p>maintenance</p>" || cr.Header.Get("Retry-After") != "60" || cr.Header.Get("Content-Type") != "text/html" {
+		t.Errorf("pinned response = %v %q %v", cr.Code, cr.Body, cr.Header)
+	}
+	if rec := do("GET", "/cache/pins", ""); !strings.Contains(rec.Body.String(), "GET example.com/a?") {
+		t.Errorf("GET = %v", rec.Body.String())
+	}
+	if rec := do("PUT", "/cache/pins?url=http://example.com/a&code=abc", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("PUT with invalid code = %v", rec.Code)
+	}
+	// BytesLimit を超えるボディは固定しない
+	if rec := do("PUT", "/cache/pins?url=http://example.com/big", strings.Repeat("x", 101)); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PUT with large body = %v", rec.Code)
+	}
+	if cache.pinned("GET example.com/big?") != nil {
+		t.Errorf("large body is pinned")
+	}
+	if rec := do("DELETE", "/cache/pins?url=http://example.com/a", ""); rec.Code != http.StatusOK {
+		t.Errorf("DELETE = %v %v", rec.Code, rec.Body.String())
+	}
+	if rec := do("DELETE", "/cache/pins?url=http://example.com/a", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE unpinned = %v", rec.Code)
+	}
+}
+
+func TestRequireAdminToken(t *testing.T) {
+	h := RequireAdminToken("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	tests := []struct {
+		authorization string
+		want          int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/cache/pins", nil)
+		if tt.authorization != "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != tt.want {
+			t.Errorf("Authorization %q: code = %v, want %v", tt.authorization, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/goccy/go-json"
+)
+
+// PostCacheConfig 参照系の POST リクエスト（GraphQL や検索APIなど）をリクエストボディ込みでキャッシュする設定
+type PostCacheConfig struct {
+	// キャッシュする POST リクエストのパス（ワイルドカード）
+	Paths []string
+	// キャッシュ対象にするリクエストボディの最大サイズ（デフォルトは 64KB）。これを超えるリクエストはキャッシュしない
+	BodyLimit int
+}
+
+// postCache は POST リクエストのボディを読み込んで正規化したハッシュを作る
+type postCache struct {
+	paths     Pattern
+	bodyLimit int
+}
+
+func newPostCache(config *PostCacheConfig) *postCache {
+	pc := &postCache{
+		paths:     NewWildCardsOr(config.Paths...),
+		bodyLimit: config.BodyLimit,
+	}
+	if pc.bodyLimit <= 0 {
+		pc.bodyLimit = 64 * 1024
+	}
+	return pc
+}
+
+// Match r がボディ込みでキャッシュする対象か
+func (pc *postCache) Match(r *http.Request) bool {
+	return r.Method == http.MethodPost && pc.paths.Match(r.URL.Path)
+}
+
+// BodyHash r のボディを読み込んでバックエンドに再送できるように差し替え、正規化したボディのハッシュを返す
+// ボディが BodyLimit を超える場合は ok=false を返す（その場合もボディは元通り読めるようにしておく）
+func (pc *postCache) BodyHash(r *http.Request) (hash string, ok bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		bufferRequestBody(r, nil)
+		return pc.hash(r.Header.Get("Content-Type"), nil), true, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(pc.bodyLimit)+1))
+	if err != nil {
+		return "", false, fmt.Errorf("could not read request body: %v", err)
+	}
+	if pc.bodyLimit < len(body) {
+		// 読んだ分と残りを繋げて元のボディとして読めるようにする
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return "", false, nil
+	}
+	r.Body.Close()
+	bufferRequestBody(r, body)
+	return pc.hash(r.Header.Get("Content-Type"), body), true, nil
+}
+
+func (pc *postCache) hash(contentType string, body []byte) string {
+	sum := sha256.Sum256(canonicalBody(contentType, body))
+	return Base64.EncodeToString(sum[:])
+}
+
+// canonicalBody 意味が同じボディが同じバイト列になるように正規化する
+// JSON はキーの順序や空白を、フォームはパラメータの順序を揃える。解釈できないものはそのまま使う
+func canonicalBody(contentType string, body []byte) []byte {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+		var v interface{}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return body
+		}
+		// 後ろに余計なデータが続いていたら正規化すると違うボディが同じキーになるのでそのまま使う
+		var rest interface{}
+		if err := dec.Decode(&rest); err != io.EOF {
+			return body
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return body
+		}
+		return b
+	case mt == "application/x-www-form-urlencoded":
+		q, err := url.ParseQuery(string(body))
+		if err != nil {
+			return body
+		}
+		return []byte(q.Encode())
+	}
+	return body
+}
+
+// bufferRequestBody r のボディを body に差し替えて、何度でも読み直せるように GetBody を設定する
+func bufferRequestBody(r *http.Request, body []byte) {
+	r.ContentLength = int64(len(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.Body, _ = r.GetBody()
+}
+
+// cloneRequest r を ctx で複製する。ボディがバッファされていれば複製側でも最初から読めるようにする
+func cloneRequest(r *http.Request, ctx context.Context) *http.Request {
+	r2 := r.Clone(ctx)
+	if r.GetBody != nil {
+		r2.Body, _ = r.GetBody()
+	}
+	return r2
+}
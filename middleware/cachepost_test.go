@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		a, b        string
+		same        bool
+	}{
+		{"json key order", "application/json", `{"query":"{a}","variables":{"x":1,"y":2}}`, `{ "variables": {"y":2, "x":1}, "query": "{a}" }`, true},
+		{"json big number", "application/json; charset=utf-8", `{"id":12345678901234567890}`, `{"id":12345678901234567891}`, false},
+		{"json suffix", "application/graphql+json", `{"b":1,"a":2}`, `{"a":2,"b":1}`, true},
+		{"json value differs", "application/json", `{"a":1}`, `{"a":2}`, false},
+		{"broken json", "application/json", `{"a":1`, `{"a":1`, true},
+		{"json trailing value", "application/json", `{"a":1}`, `{"a":1}{"evil":2}`, false},
+		{"json trailing garbage", "application/json", `{"a":1}`, `{"a":1}}`, false},
+		{"json trailing space", "application/json", `{"a":1}`, "{\"a\": 1}\n", true},
+		{"form order", "application/x-www-form-urlencoded", `b=1&a=2`, `a=2&b=1`, true},
+		{"other type is raw", "text/plain", `b=1&a=2`, `a=2&b=1`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := string(canonicalBody(tt.contentType, []byte(tt.a)))
+			b := string(canonicalBody(tt.contentType, []byte(tt.b)))
+			if (a == b) != tt.same {
+				t.Errorf("canonicalBody() = %v and %v, same want %v", a, b, tt.same)
+			}
+		})
+	}
+}
+
+func TestPostCache_BodyHash(t *testing.T) {
+	pc := newPostCache(&PostCacheConfig{Paths: []string{"/graphql"}, BodyLimit: 16})
+
+	t.Run("buffered body is replayable", func(t *testing.T) {
+		body := `{"q":"x"}`
+		r := httptest.NewRequest("POST", "/graphql", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if !pc.Match(r) {
+			t.Fatalf("Match() = false")
+		}
+		hash, ok, err := pc.BodyHash(r)
+		if hash == "" || !ok || err != nil {
+			t.Fatalf("BodyHash() = %v, %v, %v", hash, ok, err)
+		}
+		for i := 0; i < 2; i++ {
+			r2 := cloneRequest(r, r.Context())
+			got, _ := io.ReadAll(r2.Body)
+			if string(got) != body || r2.ContentLength != int64(len(body)) {
+				t.Errorf("replayed body = %q (ContentLength=%v), want %q", got, r2.ContentLength, body)
+			}
+		}
+	})
+
+	t.Run("too large body is passed through", func(t *testing.T) {
+		body := strings.Repeat("x", 100)
+		r := httptest.NewRequest("POST", "/graphql", strings.NewReader(body))
+		_, ok, err := pc.BodyHash(r)
+		if ok || err != nil {
+			t.Fatalf("BodyHash() ok = %v, err = %v", ok, err)
+		}
+		got, _ := io.ReadAll(r.Body)
+		if string(got) != body {
+			t.Errorf("body = %q, want %q", got, body)
+		}
+	})
+
+	t.Run("not matched", func(t *testing.T) {
+		if pc.Match(httptest.NewRequest("POST", "/search", nil)) || pc.Match(httptest.NewRequest("PUT", "/graphql", nil)) {
+			t.Errorf("Match() = true")
+		}
+	})
+}
@@ -0,0 +1,322 @@
+package middleware
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// ShadowConfig 本番の設定とは別の CacheConfig を全リクエストで評価だけして、ヒット率などを比較する設定
+type ShadowConfig struct {
+	// 評価する設定（MemcachedServers が空なら本番と同じ memcached を使う。キャッシュ状態は cs/ のキーに時刻だけ保存する）
+	Cache *CacheConfig
+	// キーの種類数を数える期間。期間毎にログにも集計を出す（デフォルトは 1h）
+	Window time.Duration
+	// 数えるキーの種類数の上限（デフォルトは 100000）
+	MaxKeys int
+	// 評価待ちのリクエストの最大数。溢れた分は評価しない（デフォルトは 1000）
+	QueueSize int
+}
+
+// ShadowStats 本番またはシャドウの設定での集計
+type ShadowStats struct {
+	// キャッシュをそのまま返した（した筈の）リクエスト数
+	Hit int64
+	// 期限切れのキャッシュを更新した（した筈の）リクエスト数
+	Stale int64
+	// キャッシュが無かった（無かった筈の）リクエスト数
+	Miss int64
+	// キャッシュ対象外のリクエスト数
+	Pass int64
+	// Window の間に使われたキーの種類数
+	Keys int
+	// Keys が MaxKeys に達して数え切れていない
+	KeysSaturated bool `json:",omitempty"`
+	// Hit / 全リクエスト数
+	HitRatio float64
+}
+
+// ShadowReport 本番とシャドウの設定の比較
+type ShadowReport struct {
+	// 集計を始めた時刻
+	Since time.Time
+	// 今の Keys を数え始めた時刻
+	WindowStart time.Time
+	Live        ShadowStats
+	Shadow      ShadowStats
+	// キューが溢れて評価しなかったリクエスト数
+	Dropped int64
+}
+
+type shadowOutcome int
+
+const (
+	shadowPass shadowOutcome = iota
+	shadowHit
+	shadowStale
+	shadowMiss
+)
+
+var shadowOutcomeNames = [...]string{"pass", "hit", "stale", "miss"}
+
+// シャドウ評価の集計（/debug/vars の zunproxy_cache_shadow）
+var cacheShadowMetrics = expvar.NewMap("zunproxy_cache_shadow")
+
+func init() {
+	for _, side := range []string{"live", "shadow"} {
+		side := side
+		cacheShadowMetrics.Set(side+"_hit_ratio", expvar.Func(func() interface{} {
+			var total, hit int64
+			for i, name := range shadowOutcomeNames {
+				if v, ok := cacheShadowMetrics.Get(side + "_" + name).(*expvar.Int); ok {
+					total += v.Value()
+					if shadowOutcome(i) == shadowHit {
+						hit = v.Value()
+					}
+				}
+			}
+			if total == 0 {
+				return 0.0
+			}
+			return float64(hit) / float64(total)
+		}))
+	}
+}
+
+type shadowRequest struct {
+	live          shadowOutcome
+	liveKeySource string
+	// 評価するリクエスト（本番のリクエストが終わっても使えるように複製したもの）
+	r *http.Request
+	// シャドウの設定でのキー元（run で r から求める。キャッシュ対象外なら空）
+	keySource string
+}
+
+// cacheShadow は本番の後ろで非同期にシャドウの設定を評価する
+type cacheShadow struct {
+	// シャドウの設定の keySource や Admission を使うためだけの CacheHandler（Handle はしない）
+	cache   *CacheHandler
+	window  time.Duration
+	maxKeys int
+	queue   chan shadowRequest
+
+	m           sync.Mutex
+	since       time.Time
+	windowStart time.Time
+	stats       [2]ShadowStats
+	keys        [2]map[string]struct{}
+	dropped     int64
+}
+
+func newCacheShadow(config *ShadowConfig, live *CacheHandler) *cacheShadow {
+	c := config.Cache
+	if c == nil {
+		panic(fmt.Errorf("invalid CacheConfig.Shadow: Cache is required"))
+	}
+	sc := &CacheHandler{
+		MemcachedClient: live.MemcachedClient,
+		config:          c,
+	}
+	if len(c.MemcachedServers) != 0 {
+		sc.MemcachedClient = memcache.New(c.MemcachedServers...)
+	}
+	if c.KeyNormalize != nil {
+		sc.normalizer = newURLNormalizer(c.KeyNormalize)
+	}
+	if c.PostCache != nil {
+		sc.postCache = newPostCache(c.PostCache)
+	}
+	if c.Admission != nil {
+		sc.admission = newAdmissionFilter(c.Admission)
+	}
+	sh := &cacheShadow{
+		cache:   sc,
+		window:  config.Window,
+		maxKeys: config.MaxKeys,
+		since:   time.Now(),
+	}
+	if sh.window <= 0 {
+		sh.window = time.Hour
+	}
+	if sh.maxKeys <= 0 {
+		sh.maxKeys = 100_000
+	}
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = 1000
+	}
+	sh.queue = make(chan shadowRequest, queueSize)
+	sh.resetKeys(sh.since)
+	go sh.run()
+	return sh
+}
+
+// Observe 本番での結果と一緒にリクエストを評価待ちにする（レスポンスを遅らせないように、キー元の計算も含めて評価は別の goroutine で行う）
+func (sh *cacheShadow) Observe(r *http.Request, liveKeySource string, live shadowOutcome) {
+	req := shadowRequest{
+		live:          live,
+		liveKeySource: liveKeySource,
+		r:             r.Clone(context.Background()),
+	}
+	select {
+	case sh.queue <- req:
+	default:
+		cacheShadowMetrics.Add("dropped", 1)
+		sh.m.Lock()
+		sh.dropped++
+		sh.m.Unlock()
+	}
+}
+
+// keySource シャドウの設定でのキー元（キャッシュ対象外なら空）
+func (sh *cacheShadow) keySource(r *http.Request) string {
+	ks := sh.cache.keySource(r)
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return ks
+	case sh.cache.postCache != nil && sh.cache.postCache.Match(r) && r.GetBody != nil:
+		// ボディは本番で POST をキャッシュしてバッファしてある場合だけ読み直せる
+		body, err := r.GetBody()
+		if err != nil {
+			return ""
+		}
+		sr := *r
+		sr.Body = body
+		hash, ok, err := sh.cache.postCache.BodyHash(&sr)
+		if err != nil || !ok {
+			return ""
+		}
+		return ks + " body=" + hash
+	}
+	return ""
+}
+
+func (sh *cacheShadow) run() {
+	for req := range sh.queue {
+		shadow := shadowPass
+		req.keySource = sh.keySource(req.r)
+		if req.keySource != "" {
+			var err error
+			shadow, err = sh.evaluate(req.keySource, req.r.URL.Path)
+			if err != nil {
+				log.Printf("could not evaluate shadow: %v", err)
+				continue
+			}
+		}
+		sh.record(req, shadow)
+	}
+}
+
+// evaluate シャドウの設定で keySource がヒットしたかを判定してキャッシュ状態を進める
+func (sh *cacheShadow) evaluate(keySource string, path string) (shadowOutcome, error) {
+	c := sh.cache
+	key := c.makeCacheKey("cs/", keySource)
+	now := time.Now()
+	item, err := c.MemcachedClient.Get(key)
+	if err != nil && err != memcache.ErrCacheMiss {
+		return shadowPass, err
+	}
+	outcome := shadowMiss
+	if item != nil {
+		outcome = shadowStale
+		if n, err := strconv.ParseInt(string(item.Value), 10, 64); err == nil && now.Sub(time.Unix(0, n)) < c.config.SoftTTL {
+			return shadowHit, nil
+		}
+	}
+	if outcome == shadowMiss && c.admission != nil && !c.admission.Admit(path, key) {
+		// 保存されない筈なのでミスのまま
+		return outcome, nil
+	}
+	// 本番の更新の代わりに更新した筈の時刻を保存する（ErrorTTL は考慮しない）
+	err = c.MemcachedClient.Set(&memcache.Item{
+		Key:        key,
+		Value:      []byte(strconv.FormatInt(now.UnixNano(), 10)),
+		Expiration: int32(c.config.HardTTL.Seconds()),
+	})
+	if err != nil {
+		return shadowPass, err
+	}
+	return outcome, nil
+}
+
+func (sh *cacheShadow) record(req shadowRequest, shadow shadowOutcome) {
+	cacheShadowMetrics.Add("live_"+shadowOutcomeNames[req.live], 1)
+	cacheShadowMetrics.Add("shadow_"+shadowOutcomeNames[shadow], 1)
+	sh.m.Lock()
+	defer sh.m.Unlock()
+	now := time.Now()
+	if sh.window < now.Sub(sh.windowStart) {
+		r := sh.report()
+		log.Printf("%v live hit=%.3f keys=%v shadow hit=%.3f keys=%v dropped=%v", "SHADOW", r.Live.HitRatio, r.Live.Keys, r.Shadow.HitRatio, r.Shadow.Keys, r.Dropped)
+		sh.resetKeys(now)
+	}
+	for i, o := range [2]shadowOutcome{req.live, shadow} {
+		s := &sh.stats[i]
+		switch o {
+		case shadowHit:
+			s.Hit++
+		case shadowStale:
+			s.Stale++
+		case shadowMiss:
+			s.Miss++
+		default:
+			s.Pass++
+			continue
+		}
+		ks := req.liveKeySource
+		if i == 1 {
+			ks = req.keySource
+		}
+		if _, found := sh.keys[i][ks]; !found {
+			if len(sh.keys[i]) < sh.maxKeys {
+				sh.keys[i][ks] = struct{}{}
+			} else {
+				s.KeysSaturated = true
+			}
+		}
+	}
+}
+
+func (sh *cacheShadow) resetKeys(now time.Time) {
+	sh.windowStart = now
+	for i := range sh.keys {
+		sh.keys[i] = map[string]struct{}{}
+		sh.stats[i].KeysSaturated = false
+	}
+}
+
+// report sh.m をロックして呼ぶ
+func (sh *cacheShadow) report() *ShadowReport {
+	r := &ShadowReport{
+		Since:       sh.since,
+		WindowStart: sh.windowStart,
+		Live:        sh.stats[0],
+		Shadow:      sh.stats[1],
+		Dropped:     sh.dropped,
+	}
+	for i, s := range []*ShadowStats{&r.Live, &r.Shadow} {
+		s.Keys = len(sh.keys[i])
+		if total := s.Hit + s.Stale + s.Miss + s.Pass; total != 0 {
+			s.HitRatio = float64(s.Hit) / float64(total)
+		}
+	}
+	return r
+}
+
+// ShadowReport 本番とシャドウの設定のヒット率などの比較（Shadow が無ければ nil）
+func (cache *CacheHandler) ShadowReport() *ShadowReport {
+	sh := cache.shadow
+	if sh == nil {
+		return nil
+	}
+	sh.m.Lock()
+	defer sh.m.Unlock()
+	return sh.report()
+}
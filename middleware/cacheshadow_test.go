@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCacheHandler_Shadow(t *testing.T) {
+	fm := newFakeMemcached(t)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	cache := NewCacheHandler(&CacheConfig{
+		MemcachedServers:     []string{fm.Addr()},
+		SoftTTL:              time.Minute,
+		HardTTL:              time.Hour,
+		NewResponseWaitLimit: time.Second,
+		Shadow: &ShadowConfig{
+			Cache: &CacheConfig{
+				SoftTTL:      time.Minute,
+				HardTTL:      time.Minute,
+				KeyNormalize: &KeyNormalizeConfig{DropQuery: []string{"utm_*"}},
+			},
+		},
+	}).(*CacheHandler)
+	h := cache.Handle(backend)
+	requests := 0
+	get := func(url string) {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+		requests++
+	}
+	get("http://example.com/?utm_source=a")
+	get("http://example.com/?utm_source=b")
+	get("http://example.com/?utm_source=a")
+	// 本番のキャッシュだけ期限切れにする（シャドウの SoftTTL はまだ残っている）
+	expireCacheInfo(t, cache, "GET example.com/?utm_source=a", nil)
+	get("http://example.com/?utm_source=a")
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://example.com/", nil))
+	requests++
+
+	var r *ShadowReport
+	for i := 0; i < 100; i++ {
+		r = cache.ShadowReport()
+		if r.Shadow.Hit+r.Shadow.Stale+r.Shadow.Miss+r.Shadow.Pass == int64(requests) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 本番: miss, miss, hit, stale, pass
+	if l := r.Live; l.Hit != 1 || l.Stale != 1 || l.Miss != 2 || l.Pass != 1 || l.Keys != 2 {
+		t.Errorf("Live = %+v", l)
+	}
+	// シャドウ: miss, hit, hit, hit, pass
+	if s := r.Shadow; s.Hit != 3 || s.Stale != 0 || s.Miss != 1 || s.Pass != 1 || s.Keys != 1 {
+		t.Errorf("Shadow = %+v", s)
+	}
+	if r.Shadow.HitRatio <= r.Live.HitRatio {
+		t.Errorf("HitRatio live=%v shadow=%v", r.Live.HitRatio, r.Shadow.HitRatio)
+	}
+	if cache.ShadowReport() == nil || NewCacheHandler(&CacheConfig{}).(*CacheHandler).ShadowReport() != nil {
+		t.Errorf("ShadowReport() without Shadow is not nil")
+	}
+}
@@ -0,0 +1,207 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/goccy/go-json"
+)
+
+// VersionsConfig 過去のレスポンスを保持して、壊れたデプロイの後などにロールバックできるようにする設定
+type VersionsConfig struct {
+	// 保持する過去の世代数（デフォルトは 3、CacheInfo が大きくなりすぎないように最大 20）
+	Keep int
+	// 過去の世代を保持する期間（デフォルトは HardTTL）
+	TTL time.Duration
+	// タグ名 => パスのワイルドカード。ロールバック対象をタグで指定できる
+	Tags map[string][]string
+}
+
+// CacheVersion 過去のレスポンスの情報（レスポンス本体は Key のアイテムに保存する）
+type CacheVersion struct {
+	// ボディのハッシュ
+	BodyHash string
+	// このレスポンスが使われ始めた
+	Since time.Time
+	// このレスポンスが置き換えられた
+	Until time.Time
+	// レスポンスを保存した memcached のキー
+	Key string
+}
+
+const (
+	defaultVersionsKeep = 3
+	maxVersionsKeep     = 20
+)
+
+type cacheVersions struct {
+	keep int
+	ttl  time.Duration
+	tags map[string]Pattern
+}
+
+func newCacheVersions(config *VersionsConfig, hardTTL time.Duration) *cacheVersions {
+	cv := &cacheVersions{
+		keep: config.Keep,
+		ttl:  config.TTL,
+		tags: map[string]Pattern{},
+	}
+	if cv.keep <= 0 {
+		cv.keep = defaultVersionsKeep
+	}
+	if cv.keep > maxVersionsKeep {
+		cv.keep = maxVersionsKeep
+	}
+	if cv.ttl <= 0 {
+		cv.ttl = hardTTL
+	}
+	for tag, paths := range config.Tags {
+		cv.tags[tag] = NewWildCardsOr(paths...)
+	}
+	return cv
+}
+
+// Tags path に付けるタグ
+func (cv *cacheVersions) Tags(path string) []string {
+	var tags []string
+	for tag, p := range cv.tags {
+		if p.Match(path) {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// pushVersion 今のレスポンスを過去の世代として保存する
+func (cache *CacheHandler) pushVersion(ci *CacheInfo) error {
+	cv := cache.versions
+	since := ci.BodyChanged
+	if since.IsZero() {
+		since = ci.Created
+	}
+	v := CacheVersion{
+		BodyHash: ci.BodyHash,
+		Since:    since,
+		Until:    time.Now(),
+		Key:      cache.makeCacheKey("cv/", ci.KeySource+" "+ci.BodyHash+" "+strconv.FormatInt(since.UnixNano(), 10)),
+	}
+	crBytes, err := json.Marshal(ci.CachedResponse)
+	if err != nil {
+		return fmt.Errorf("could not marshal CachedResponse: %v", err)
+	}
+	value, err := cache.encodeValue(v.Key, crBytes)
+	if err != nil {
+		return err
+	}
+	err = cache.MemcachedClient.Set(&memcache.Item{Key: v.Key, Value: value, Expiration: int32(cv.ttl.Seconds())})
+	if err != nil {
+		return fmt.Errorf("could not save version %v: %v", v.Key, err)
+	}
+	ci.Versions = append([]CacheVersion{v}, ci.Versions...)
+	if cv.keep < len(ci.Versions) {
+		for _, old := range ci.Versions[cv.keep:] {
+			cache.MemcachedClient.Delete(old.Key)
+		}
+		ci.Versions = ci.Versions[:cv.keep]
+	}
+	return nil
+}
+
+// loadVersion 過去の世代のレスポンスを取り出す
+func (cache *CacheHandler) loadVersion(v CacheVersion) (*CachedResponse, error) {
+	item, err := cache.MemcachedClient.Get(v.Key)
+	if err != nil {
+		return nil, fmt.Errorf("could not load version %v: %v", v.Key, err)
+	}
+	value, err := cache.decodeValue(item.Key, item.Value)
+	if err != nil {
+		return nil, err
+	}
+	var cr CachedResponse
+	if err := json.Unmarshal(value, &cr); err != nil {
+		return nil, fmt.Errorf("could not unmarshal version %v: %v", v.Key, err)
+	}
+	return &cr, nil
+}
+
+// Rollback keySource のキャッシュを過去の世代に戻して pin の間は更新しないように固定する
+// before が指定されていればその時点で使われていた世代に、そうでなければ一つ前の世代に戻す
+// tag が指定されていればそのタグが付いたキャッシュだけを対象にする
+// ロールバックしなかった場合は false を返す
+func (cache *CacheHandler) Rollback(keySource string, tag string, before time.Time, pin time.Duration) (bool, error) {
+	if cache.versions == nil {
+		return false, fmt.Errorf("Versions is not configured")
+	}
+	ci, err := cache.getCacheInfo(keySource)
+	if err != nil {
+		return false, err
+	}
+	if ci.CachedResponse == nil {
+		return false, nil
+	}
+	if tag != "" && !containsString(ci.Tags, tag) {
+		return false, nil
+	}
+	idx := -1
+	if before.IsZero() {
+		if len(ci.Versions) != 0 {
+			idx = 0
+		}
+	} else {
+		if !ci.BodyChanged.IsZero() && ci.BodyChanged.Before(before) {
+			// 指定時刻には既に今のレスポンスが使われていた
+			return false, nil
+		}
+		for i, v := range ci.Versions {
+			if v.Since.Before(before) {
+				idx = i
+				break
+			}
+		}
+	}
+	if idx == -1 {
+		return false, nil
+	}
+	v := ci.Versions[idx]
+	cr, err := cache.loadVersion(v)
+	if err != nil {
+		return false, err
+	}
+	// 戻す前のレスポンスも過去の世代として残しておく
+	ci.Versions = append(ci.Versions[:idx:idx], ci.Versions[idx+1:]...)
+	if err := cache.pushVersion(ci); err != nil {
+		return false, err
+	}
+	ci.CachedResponse = cr
+	ci.BodyHash = v.BodyHash
+	ci.BodyChanged = v.Since
+	now := time.Now()
+	pinnedUntil := now.Add(pin)
+	ci.PinnedUntil = &pinnedUntil
+	ci.Saved = now
+	ci.Expires = now.Add(cache.config.SoftTTL)
+	// HardTTL より長く固定する場合は固定が終わるまで消えないようにする
+	expiration := cache.config.HardTTL
+	if expiration < pin {
+		expiration = pin
+	}
+	if err := cache.saveCacheInfo(ci, expiration); err != nil {
+		return false, err
+	}
+	log.Printf("%v %v pin=%v %v %v", "ROLLBACK", ci.Key, pin, v.Since.Format(time.RFC3339), ci.KeySource)
+	return true, nil
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
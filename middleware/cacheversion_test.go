@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheVersions_Tags(t *testing.T) {
+	cv := newCacheVersions(&VersionsConfig{Tags: map[string][]string{
+		"news":   {"/news/*"},
+		"static": {"*.css", "*.js"},
+		"all":    {"*"},
+	}}, time.Hour)
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/news/1", []string{"all", "news"}},
+		{"/a.js", []string{"all", "static"}},
+		{"/", []string{"all"}},
+	}
+	for _, tt := range tests {
+		if got := cv.Tags(tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Tags(%v) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCacheVersions_Keep(t *testing.T) {
+	tests := []struct {
+		keep int
+		want int
+	}{
+		{0, defaultVersionsKeep},
+		{-1, defaultVersionsKeep},
+		{5, 5},
+		{1000, maxVersionsKeep},
+	}
+	for _, tt := range tests {
+		if got := newCacheVersions(&VersionsConfig{Keep: tt.keep}, time.Hour).keep; got != tt.want {
+			t.Errorf("Keep %v = %v, want %v", tt.keep, got, tt.want)
+		}
+	}
+}
+
+func TestCacheHandler_Rollback(t *testing.T) {
+	fm := newFakeMemcached(t)
+	var body atomic.Value
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body.Load().(string)))
+	})
+	cache := NewCacheHandler(&CacheConfig{
+		MemcachedServers:     []string{fm.Addr()},
+		SoftTTL:              20 * time.Millisecond,
+		HardTTL:              time.Hour,
+		NewResponseWaitLimit: time.Second,
+		Versions: &VersionsConfig{
+			Keep: 2,
+			Tags: map[string][]string{"news": {"/news/*"}},
+		},
+	}).(*CacheHandler)
+	h := cache.Handle(backend)
+	get := func() string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/news/1", nil))
+		return rec.Body.String()
+	}
+	keySource := "GET example.com/news/1?"
+	refresh := func(s string) {
+		body.Store(s)
+		time.Sleep(30 * time.Millisecond)
+		if got := get(); got != s {
+			t.Fatalf("refreshed body = %q, want %q", got, s)
+		}
+	}
+
+	refresh("v1")
+	refresh("v1")
+	time.Sleep(5 * time.Millisecond)
+	beforeV2 := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	refresh("v2")
+	refresh("v3")
+	refresh("v4")
+
+	ci, _ := cache.getCacheInfo(keySource)
+	if len(ci.Versions) != 2 || ci.Versions[0].Since.After(ci.Versions[0].Until) {
+		t.Fatalf("Versions = %+v, want 2 versions", ci.Versions)
+	}
+	// 固定していないエントリには PinnedUntil を保存しない
+	if strings.Contains(string(ci.mcItem.Value), "PinnedUntil") {
+		t.Errorf("stored CacheInfo has PinnedUntil: %s", ci.mcItem.Value)
+	}
+
+	// タグが違えば何もしない
+	if ok, err := cache.Rollback(keySource, "other", time.Time{}, time.Hour); ok || err != nil {
+		t.Errorf("Rollback(other tag) = %v, %v", ok, err)
+	}
+	// 一つ前に戻して固定される
+	if ok, err := cache.Rollback(keySource, "news", time.Time{}, 3*time.Hour); !ok || err != nil {
+		t.Fatalf("Rollback() = %v, %v", ok, err)
+	}
+	// HardTTL より長く固定したらその間は消えない
+	if exp := time.Until(fm.Expires(ci.Key)); exp < 3*time.Hour-time.Minute {
+		t.Errorf("expiration = %v, want about 3h", exp)
+	}
+	body.Store("v5")
+	time.Sleep(30 * time.Millisecond)
+	if got := get(); got != "v3" {
+		t.Errorf("pinned body = %q, want v3", got)
+	}
+	// 指定時刻に使われていた世代（v1 は Keep を超えて消えているので戻せない）
+	if ok, _ := cache.Rollback(keySource, "", beforeV2, time.Hour); ok {
+		t.Errorf("Rollback(before v2) = true, want false")
+	}
+	// 戻す前の v4 も世代として残っている
+	ci, _ = cache.getCacheInfo(keySource)
+	if len(ci.Versions) == 0 {
+		t.Fatalf("Versions is empty")
+	}
+	if cr, err := cache.loadVersion(ci.Versions[0]); err != nil || string(cr.Body) != "v4" {
+		t.Errorf("latest version = %v, %v, want v4", cr, err)
+	}
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// errUnsupportedContentEncoding 展開できない Content-Encoding（zstd など）。壊れているわけではないので検査せずに通す
+var errUnsupportedContentEncoding = errors.New("unsupported Content-Encoding")
+
+const (
+	// 展開後のサイズの上限は受け取ったボディのこの倍数まで（圧縮爆弾対策）
+	maxDecodeRatio = 100
+	// ただし小さいボディでもここまでは展開を許す
+	minDecodeLimit = 1 << 20
+)
+
+// decodeContentEncoding Content-Encoding に従ってボディを展開する
+// "gzip, br" のように複数重ねられている場合は後ろから順に展開する
+// 展開できない Content-Encoding が含まれていたら errUnsupportedContentEncoding を返す
+func decodeContentEncoding(header http.Header, body []byte) ([]byte, error) {
+	var encodings []string
+	for _, v := range header.Values("Content-Encoding") {
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.ToLower(strings.TrimSpace(e)); e != "" && e != "identity" {
+				encodings = append(encodings, e)
+			}
+		}
+	}
+	for _, e := range encodings {
+		switch e {
+		case "gzip", "x-gzip", "deflate", "br":
+		default:
+			return nil, fmt.Errorf("%w: %v", errUnsupportedContentEncoding, e)
+		}
+	}
+	limit := len(body) * maxDecodeRatio
+	if limit < minDecodeLimit {
+		limit = minDecodeLimit
+	}
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var reader io.Reader
+		var err error
+		switch encodings[i] {
+		case "gzip", "x-gzip":
+			reader, err = gzip.NewReader(bytes.NewReader(body))
+		case "deflate":
+			// 本来は zlib 形式だが生の deflate を返すサーバもあるのでどちらも受け付ける
+			reader, err = zlib.NewReader(bytes.NewReader(body))
+			if err != nil {
+				reader, err = flate.NewReader(bytes.NewReader(body)), nil
+			}
+		case "br":
+			reader = brotli.NewReader(bytes.NewReader(body))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not decode %v: %v", encodings[i], err)
+		}
+		body, err = io.ReadAll(io.LimitReader(reader, int64(limit)+1))
+		if err != nil {
+			return nil, fmt.Errorf("could not decode %v: %v", encodings[i], err)
+		}
+		if limit < len(body) {
+			return nil, fmt.Errorf("could not decode %v: decoded body exceeds %d bytes", encodings[i], limit)
+		}
+	}
+	return body, nil
+}
@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func encodeForTest(t *testing.T, encoding string, body []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "rawdeflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	default:
+		t.Fatalf("unknown encoding %v", encoding)
+	}
+	w.Write(body)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestDecodeContentEncoding(t *testing.T) {
+	plain := []byte("<html><body>hello</body></html>")
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		wantErr  bool
+	}{
+		{"identity", "", plain, false},
+		{"explicit identity", "identity", plain, false},
+		{"gzip", "gzip", encodeForTest(t, "gzip", plain), false},
+		{"deflate", "deflate", encodeForTest(t, "deflate", plain), false},
+		{"raw deflate", "deflate", encodeForTest(t, "rawdeflate", plain), false},
+		{"br", "br", encodeForTest(t, "br", plain), false},
+		{"stacked", "gzip, br", encodeForTest(t, "br", encodeForTest(t, "gzip", plain)), false},
+		{"broken gzip", "gzip", plain, true},
+		{"truncated gzip", "gzip", encodeForTest(t, "gzip", plain)[:20], true},
+		{"bomb", "gzip", encodeForTest(t, "gzip", bytes.Repeat([]byte("a"), minDecodeLimit+1)), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.encoding != "" {
+				header.Set("Content-Encoding", tt.encoding)
+			}
+			got, err := decodeContentEncoding(header, tt.body)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeContentEncoding() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(got, plain) {
+				t.Errorf("decodeContentEncoding() = %q, want %q", got, plain)
+			}
+		})
+	}
+}
+
+func TestDecodeContentEncoding_Unsupported(t *testing.T) {
+	for _, encoding := range []string{"zstd", "compress", "gzip, zstd"} {
+		header := http.Header{"Content-Encoding": {encoding}}
+		if _, err := decodeContentEncoding(header, []byte("x")); !errors.Is(err, errUnsupportedContentEncoding) {
+			t.Errorf("decodeContentEncoding(%q) error = %v, want errUnsupportedContentEncoding", encoding, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"math/rand"
@@ -31,6 +32,7 @@ type dumpContent struct {
 
 type dumpReq struct {
 	Method   string
+	Host     string
 	Path     string
 	Query    url.Values
 	RawPath  string
@@ -44,6 +46,32 @@ type dumpRes struct {
 	Truncated     bool
 }
 
+// LoadDumpRequest ダンプの json から元のリクエストを復元する（ボディは含まない）
+func LoadDumpRequest(reader io.Reader) (*http.Request, error) {
+	var dump dumpContent
+	if err := json.NewDecoder(reader).Decode(&dump); err != nil {
+		return nil, fmt.Errorf("could not decode dump json: %v", err)
+	}
+	if dump.Request.Host == "" {
+		return nil, fmt.Errorf("dump %v has no Host", dump.ID)
+	}
+	u := &url.URL{
+		Scheme:   "http",
+		Host:     dump.Request.Host,
+		Path:     dump.Request.Path,
+		RawPath:  dump.Request.RawPath,
+		RawQuery: dump.Request.RawQuery,
+	}
+	r, err := http.NewRequest(dump.Request.Method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if dump.Request.Header != nil {
+		r.Header = dump.Request.Header
+	}
+	return r, nil
+}
+
 func NewDumpHandler(dumpDir string) Middleware {
 	return &dumpHandler{
 		DumpDir: dumpDir,
@@ -56,6 +84,11 @@ func (dh *dumpHandler) Handle(next http.Handler) http.Handler {
 		return next
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isUpgradeRequest(r) {
+			// Upgrade 後の通信は記録できないのでそのまま流す
+			next.ServeHTTP(w, r)
+			return
+		}
 		// リクエストの記録開始
 		tsStart := time.Now()
 		dumpDir := timefmt.Format(tsStart, dh.DumpDir)
@@ -64,6 +97,7 @@ func (dh *dumpHandler) Handle(next http.Handler) http.Handler {
 			Ts: tsStart,
 			Request: dumpReq{
 				Method:   r.Method,
+				Host:     r.Host,
 				Path:     r.URL.Path,
 				Query:    r.URL.Query(),
 				RawPath:  r.URL.RawPath,
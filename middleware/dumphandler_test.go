@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadDumpRequest(t *testing.T) {
+	dir := t.TempDir()
+	dh := NewDumpHandler(dir)
+	h := dh.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok"))
+	}))
+	r := httptest.NewRequest("GET", "http://example.com:8080/a/b?x=1&y=2", nil)
+	r.Header.Set("X-Foo", "bar")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("dump json files = %v", files)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := LoadDumpRequest(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Method != "GET" || got.Host != "example.com:8080" || got.URL.Path != "/a/b" || got.URL.RawQuery != "x=1&y=2" || got.Header.Get("X-Foo") != "bar" {
+		t.Errorf("LoadDumpRequest() = %v %v%v?%v %v", got.Method, got.Host, got.URL.Path, got.URL.RawQuery, got.Header)
+	}
+}
@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/goccy/go-json"
+)
+
+// BrokenRewriteGuardConfig 壊れたレスポンスをエラーに差し替える BrokenRewriteGuard の設定
+type BrokenRewriteGuardConfig struct {
+	// レスポンスを検査するルール（マッチした全てのルールで検査する。nil ならデフォルトの HTML の閉じタグのチェックだけ）
+	Rules []GuardRule
+	// 壊れていた時に返すステータスコード（デフォルトは 500）
+	ErrorStatus int
+	// 壊れていた時に返すボディと Content-Type（デフォルトは 5 秒後にリロードする HTML）
+	ErrorBody        string
+	ErrorContentType string
+}
+
+// GuardRule Path, ContentType, Codes にマッチしたレスポンスのボディの検査
+type GuardRule struct {
+	// ログに出す名前
+	Name string
+	// パスのワイルドカード（省略時は全て）
+	Path string
+	// Content-Type のワイルドカード（省略時は全て）
+	ContentType string
+	// 対象のステータスコード（省略時は 200）
+	Codes []int
+	// ボディに含まれているべき閉じ側の目印（"</html>" など）
+	EndMarker string
+	// これがボディに含まれている場合だけ EndMarker を求める（"<html" など。省略時は常に求める）
+	StartMarker string
+	// ボディにマッチしなければならない正規表現
+	MustMatch string
+	// ボディにマッチしてはならない正規表現
+	MustNotMatch string
+	// ボディの最小サイズ
+	MinBytes int
+	// ボディが JSON として正しいこと
+	ValidJSON bool
+	// ボディが UTF-8 として正しく U+FFFD（文字化けの置換文字）を含まないこと
+	ValidUTF8 bool
+	// Content-Length ヘッダが実際のボディの長さと一致すること
+	ContentLength bool
+}
+
+// defaultGuardRules 設定が無い場合のルール（元々の固定のチェック）
+var defaultGuardRules = []GuardRule{{
+	Name:        "html",
+	ContentType: "text/html*",
+	EndMarker:   "</html>",
+	StartMarker: "<html",
+}}
+
+const defaultGuardErrorBody = `<!DOCTYPE html><html><head><meta charset="utf-8"><script>setTimeout(function(){location.reload()}, 5000)</script></head><body>Server Error. Reload after 5 seconds...</body></html>\n`
+
+type guardRule struct {
+	GuardRule
+	path         Pattern
+	contentType  Pattern
+	mustMatch    *regexp.Regexp
+	mustNotMatch *regexp.Regexp
+}
+
+func newGuardRules(rules []GuardRule) ([]*guardRule, error) {
+	if rules == nil {
+		rules = defaultGuardRules
+	}
+	var grs []*guardRule
+	for i, r := range rules {
+		gr := &guardRule{GuardRule: r, path: anyPattern, contentType: anyPattern}
+		if gr.Name == "" {
+			gr.Name = "rule" + strconv.Itoa(i)
+		}
+		if len(gr.Codes) == 0 {
+			gr.Codes = []int{http.StatusOK}
+		}
+		if r.Path != "" {
+			gr.path = NewWildCard(r.Path)
+		}
+		if r.ContentType != "" {
+			gr.contentType = NewWildCard(r.ContentType)
+		}
+		var err error
+		if r.MustMatch != "" {
+			if gr.mustMatch, err = regexp.Compile(r.MustMatch); err != nil {
+				return nil, fmt.Errorf("invalid MustMatch of %v: %w", gr.Name, err)
+			}
+		}
+		if r.MustNotMatch != "" {
+			if gr.mustNotMatch, err = regexp.Compile(r.MustNotMatch); err != nil {
+				return nil, fmt.Errorf("invalid MustNotMatch of %v: %w", gr.Name, err)
+			}
+		}
+		grs = append(grs, gr)
+	}
+	return grs, nil
+}
+
+// Match 検査対象のレスポンスか
+// HEAD と 204/304 はボディが無いのが正しいので検査しない
+func (gr *guardRule) Match(method string, path string, code int, header http.Header) bool {
+	if method == http.MethodHead || code == http.StatusNoContent || code == http.StatusNotModified {
+		return false
+	}
+	if !gr.path.Match(path) || !gr.contentType.Match(header.Get("Content-Type")) {
+		return false
+	}
+	for _, c := range gr.Codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Check 壊れていたら理由を返す。raw は受け取ったままのボディ、plain は Content-Encoding を展開したボディ
+func (gr *guardRule) Check(header http.Header, raw []byte, plain []byte) string {
+	if gr.ContentLength {
+		if cl := header.Get("Content-Length"); cl != "" && cl != strconv.Itoa(len(raw)) {
+			return fmt.Sprintf("Content-Length %v != %v", cl, len(raw))
+		}
+	}
+	if len(plain) < gr.MinBytes {
+		return fmt.Sprintf("too small %v < %v", len(plain), gr.MinBytes)
+	}
+	if gr.EndMarker != "" && (gr.StartMarker == "" || bytes.Contains(plain, []byte(gr.StartMarker))) && !bytes.Contains(plain, []byte(gr.EndMarker)) {
+		return "no " + gr.EndMarker
+	}
+	if gr.mustMatch != nil && !gr.mustMatch.Match(plain) {
+		return "not match " + gr.MustMatch
+	}
+	if gr.mustNotMatch != nil && gr.mustNotMatch.Match(plain) {
+		return "match " + gr.MustNotMatch
+	}
+	if gr.ValidJSON && !json.Valid(plain) {
+		return "invalid JSON"
+	}
+	if gr.ValidUTF8 {
+		if !utf8.Valid(plain) {
+			return "invalid UTF-8"
+		}
+		if bytes.ContainsRune(plain, utf8.RuneError) {
+			return "found \\uFFFD"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMemcached はテスト用の最低限の memcached テキストプロトコルサーバ
+type fakeMemcached struct {
+	ln    net.Listener
+	items map[string]*fakeItem
+	cas   uint64
+	count map[string]int
+	// キー毎に値を返した回数
+	fetched map[string]int
+	m       sync.Mutex
+}
+
+type fakeItem struct {
+	value   []byte
+	flags   uint32
+	expires time.Time
+	cas     uint64
+}
+
+func newFakeMemcached(t *testing.T) *fakeMemcached {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm := &fakeMemcached{ln: ln, items: map[string]*fakeItem{}, count: map[string]int{}, fetched: map[string]int{}}
+	go fm.serve()
+	t.Cleanup(func() { ln.Close() })
+	return fm
+}
+
+func (fm *fakeMemcached) Addr() string {
+	return fm.ln.Addr().String()
+}
+
+// Keys 期限切れでないキーの一覧
+func (fm *fakeMemcached) Keys() []string {
+	fm.m.Lock()
+	defer fm.m.Unlock()
+	var keys []string
+	for k := range fm.items {
+		if fm.get(k) != nil {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// Count コマンドが呼ばれた回数
+func (fm *fakeMemcached) Count(cmd string) int {
+	fm.m.Lock()
+	defer fm.m.Unlock()
+	return fm.count[cmd]
+}
+
+// Fetched get/gets で key の値を返した回数
+func (fm *fakeMemcached) Fetched(key string) int {
+	fm.m.Lock()
+	defer fm.m.Unlock()
+	return fm.fetched[key]
+}
+
+// Expires key の有効期限
+func (fm *fakeMemcached) Expires(key string) time.Time {
+	fm.m.Lock()
+	defer fm.m.Unlock()
+	if it := fm.get(key); it != nil {
+		return it.expires
+	}
+	return time.Time{}
+}
+
+func (fm *fakeMemcached) serve() {
+	for {
+		c, err := fm.ln.Accept()
+		if err != nil {
+			return
+		}
+		go fm.handle(c)
+	}
+}
+
+func (fm *fakeMemcached) get(key string) *fakeItem {
+	it, ok := fm.items[key]
+	if !ok {
+		return nil
+	}
+	if !it.expires.IsZero() && time.Now().After(it.expires) {
+		delete(fm.items, key)
+		return nil
+	}
+	return it
+}
+
+func fakeExpires(exp int64) time.Time {
+	switch {
+	case exp == 0:
+		return time.Time{}
+	case exp < 0:
+		return time.Now().Add(-time.Second)
+	case exp <= 60*60*24*30:
+		return time.Now().Add(time.Duration(exp) * time.Second)
+	}
+	return time.Unix(exp, 0)
+}
+
+func (fm *fakeMemcached) handle(c net.Conn) {
+	defer c.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		fm.command(rw, args)
+		if rw.Flush() != nil {
+			return
+		}
+	}
+}
+
+func (fm *fakeMemcached) command(rw *bufio.ReadWriter, args []string) {
+	fm.m.Lock()
+	defer fm.m.Unlock()
+	fm.count[args[0]]++
+	switch cmd := args[0]; cmd {
+	case "get", "gets":
+		for _, k := range args[1:] {
+			if it := fm.get(k); it != nil {
+				fm.fetched[k]++
+				fmt.Fprintf(rw, "VALUE %s %d %d %d\r\n%s\r\n", k, it.flags, len(it.value), it.cas, it.value)
+			}
+		}
+		fmt.Fprintf(rw, "END\r\n")
+	case "set", "add", "replace", "cas":
+		flags, _ := strconv.ParseUint(args[2], 10, 32)
+		exp, _ := strconv.ParseInt(args[3], 10, 64)
+		size, _ := strconv.Atoi(args[4])
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rw, data); err != nil {
+			return
+		}
+		key := args[1]
+		old := fm.get(key)
+		switch {
+		case cmd == "add" && old != nil:
+			fmt.Fprintf(rw, "NOT_STORED\r\n")
+			return
+		case cmd == "replace" && old == nil:
+			fmt.Fprintf(rw, "NOT_STORED\r\n")
+			return
+		case cmd == "cas" && old == nil:
+			fmt.Fprintf(rw, "NOT_FOUND\r\n")
+			return
+		case cmd == "cas" && args[5] != strconv.FormatUint(old.cas, 10):
+			fmt.Fprintf(rw, "EXISTS\r\n")
+			return
+		}
+		fm.cas++
+		fm.items[key] = &fakeItem{value: data[:size], flags: uint32(flags), expires: fakeExpires(exp), cas: fm.cas}
+		fmt.Fprintf(rw, "STORED\r\n")
+	case "delete":
+		if fm.get(args[1]) == nil {
+			fmt.Fprintf(rw, "NOT_FOUND\r\n")
+			return
+		}
+		delete(fm.items, args[1])
+		fmt.Fprintf(rw, "DELETED\r\n")
+	case "touch":
+		it := fm.get(args[1])
+		if it == nil {
+			fmt.Fprintf(rw, "NOT_FOUND\r\n")
+			return
+		}
+		exp, _ := strconv.ParseInt(args[2], 10, 64)
+		it.expires = fakeExpires(exp)
+		fmt.Fprintf(rw, "TOUCHED\r\n")
+	case "incr", "decr":
+		it := fm.get(args[1])
+		if it == nil {
+			fmt.Fprintf(rw, "NOT_FOUND\r\n")
+			return
+		}
+		n, _ := strconv.ParseUint(string(it.value), 10, 64)
+		delta, _ := strconv.ParseUint(args[2], 10, 64)
+		if cmd == "incr" {
+			n += delta
+		} else if delta < n {
+			n -= delta
+		} else {
+			n = 0
+		}
+		it.value = []byte(strconv.FormatUint(n, 10))
+		fmt.Fprintf(rw, "%d\r\n", n)
+	case "flush_all":
+		fm.items = map[string]*fakeItem{}
+		fmt.Fprintf(rw, "OK\r\n")
+	case "version":
+		fmt.Fprintf(rw, "VERSION fake\r\n")
+	default:
+		fmt.Fprintf(rw, "ERROR\r\n")
+	}
+}
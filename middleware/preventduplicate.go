@@ -1,31 +1,152 @@
 package middleware
 
 import (
-	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"log"
 	"net/http"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/kawaz/go-requestid"
 )
 
 type RequestBundler interface {
 	Handle(next http.Handler) http.Handler
+	// Waiters 実行中のリクエスト毎の待っているクライアント数（デバッグ用）
+	Waiters() []BundlerWaiters
 }
 
 // RequestBundler 重複する同時リクエストは一つだけバックエンドに流してレスポンスをシェアすることで高速化を図るミドルウェア
-// リクエストの一意性はデフォルトの RequestIDGenerator を利用する
+// リクエストの一意性は RequestBundlerConfig のデフォルトで判定する（GET, HEAD, OPTIONS を、全てのヘッダとクッキー、utm_* などを除いたクエリで区別する）
+// 以前は requestid のデフォルトの RequestIDGenerator を使っていたが、Origin, Authorization も区別するようになった
 func NewRequestBundlerDefault() Middleware {
 	return NewRequestBundler(nil)
 }
 
 // NewRequestBundler 重複する同時リクエストは一つだけバックエンドに流してレスポンスをシェアすることで高速化を図るミドルウェア
-// idgen でリクエストの一意性を調整する
+// idgen でリクエストの一意性を調整する（nil なら NewRequestBundlerDefault と同じ）
 func NewRequestBundler(idgen *requestid.RequestIDGenerator) Middleware {
+	return newRequestBundler(&RequestBundlerConfig{}, idgen)
+}
+
+// RequestBundlerConfig RequestBundler の設定
+type RequestBundlerConfig struct {
+	// 代表リクエストがバックエンドを待つ最大時間（デフォルトは 30s）
+	Timeout time.Duration
+	// 纏める対象のメソッド（nil ならデフォルトの GET, HEAD, OPTIONS）
+	Methods []string
+	// 纏める対象のパス（ワイルドカード "/api/*" など。nil なら全て）
+	Paths []string
+	// 纏めないパス（ワイルドカード）
+	ExceptPaths []string
+	// 同じリクエストかの判定に使うヘッダ（ワイルドカード。nil なら全て。Cookie ヘッダは Cookies で指定する）
+	Headers []string
+	// 判定に使うクエリパラメータ（ワイルドカード。nil なら全て）
+	QueryAccept []string
+	// 判定に使わないクエリパラメータ（ワイルドカード。nil ならデフォルトの utm_*, gclid, fbclid）
+	QueryDrop []string
+	// 判定に使うクッキー（ワイルドカード。nil なら全て）
+	Cookies []string
+	// リクエストボディがあるリクエストは纏めない（ボディは判定に使わないので GET, HEAD, OPTIONS 以外は常に纏めない）
+	SkipBody bool
+	// Authorization ヘッダがあるリクエストは纏めない
+	SkipAuthorization bool
+	// 完了したレスポンスを暫く残して同じリクエストに返す（nil なら完了したらすぐ捨てる）
+	MicroCache *MicroCacheConfig
+	// 一つのリクエストを待てるクライアントの最大数（0 なら無制限）
+	MaxWaiters int
+	// 同時にバックエンドに流すリクエストの最大数（0 なら無制限）
+	MaxInFlight int
+	// 制限を超えた時に返すステータスコード（デフォルトは 503）
+	RejectStatus int
+	// 制限を超えた時に返す Retry-After（デフォルトは 1s。秒単位に切り上げる）
+	RetryAfter time.Duration
+	// 制限を超えた時に返すボディ
+	RejectBody string
+	// 代表リクエストのレスポンスをメモリに持つ最大サイズ（デフォルトは 8MB）
+	// 超えたら後から来たリクエストは纏めずにバックエンドに流し、全員が読み終わった部分は捨てる
+	MaxBytes int
+	// 読むのが MaxBytes 以上遅れたクライアントを待つ最大時間（デフォルトは 5s）
+	// その間はバックエンドからの読み込みを止めて、過ぎても追い付かないクライアントへのレスポンスは打ち切る
+	SlowClientTimeout time.Duration
+}
+
+// BundlerWaiters 実行中のリクエストと待っているクライアント数
+type BundlerWaiters struct {
+	// 代表リクエストの "METHOD host/path?query"
+	Request string
+	Waiters int
+	// 代表リクエストを始めた時刻
+	Started time.Time
+	// 完了して MicroCache に残っている
+	Finished bool `json:",omitempty"`
+}
+
+var (
+	errTooManyWaiters  = errors.New("too many waiters")
+	errTooManyInFlight = errors.New("too many in-flight requests")
+	// MaxBytes を超えて最初から返せなくなった
+	errResponseTooLarge = errors.New("response too large")
+	// 読むのが遅れて読む前の部分を捨てられた
+	errSlowReader = errors.New("slow reader")
+	// 代表リクエストのレスポンスが途中で中断された
+	errResponseAborted = errors.New("response aborted")
+)
+
+// 制限を超えて断ったリクエスト数（/debug/vars の zunproxy_bundler）
+var bundlerMetrics = expvar.NewMap("zunproxy_bundler")
+
+// NewRequestBundlerWithConfig 設定を指定して RequestBundler を作る（config が nil ならデフォルト）
+func NewRequestBundlerWithConfig(config *RequestBundlerConfig) Middleware {
+	if config == nil {
+		config = &RequestBundlerConfig{}
+	}
+	return newRequestBundler(config, nil)
+}
+
+func newRequestBundler(config *RequestBundlerConfig, idgen *requestid.RequestIDGenerator) *requestBundler {
+	if idgen == nil {
+		idgen = newBundlerIDGenerator(config)
+	}
 	rb := &requestBundler{
-		idgen: idgen,
-		dw:    map[requestid.RequestID]*DuplicateWriter{},
-		dwM:   sync.Mutex{},
+		idgen:             idgen,
+		timeout:           config.Timeout,
+		maxWaiters:        config.MaxWaiters,
+		maxInFlight:       config.MaxInFlight,
+		rejectStatus:      config.RejectStatus,
+		rejectBody:        []byte(config.RejectBody),
+		maxBytes:          config.MaxBytes,
+		slowClientTimeout: config.SlowClientTimeout,
+		skipBody:          config.SkipBody,
+		skipAuthorization: config.SkipAuthorization,
+		dw:                map[requestid.RequestID]*DuplicateWriter{},
+		dwM:               sync.Mutex{},
+	}
+	if rb.timeout <= 0 {
+		rb.timeout = 30 * time.Second
+	}
+	if rb.maxBytes <= 0 {
+		rb.maxBytes = 8 << 20
+	}
+	if rb.slowClientTimeout <= 0 {
+		rb.slowClientTimeout = 5 * time.Second
 	}
+	if config.MicroCache != nil {
+		rb.microCache = newMicroCache(config.MicroCache)
+	}
+	if rb.rejectStatus == 0 {
+		rb.rejectStatus = http.StatusServiceUnavailable
+	}
+	retryAfter := config.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = time.Second
+	}
+	rb.retryAfter = strconv.Itoa(int((retryAfter + time.Second - 1) / time.Second))
 	return rb
 }
 
@@ -34,70 +155,208 @@ func (dp *requestBundler) Handle(next http.Handler) http.Handler {
 		dp.idgen = requestid.NewDefaultRequestIDGeneratorConfig().NewGenerator()
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dp.skip(r) || isStreamingRequest(r) || isUpgradeRequest(r) {
+			// ストリーミングや Upgrade は代表リクエストのタイムアウトで切れてしまうし共有もできないので纏めない
+			next.ServeHTTP(w, r)
+			return
+		}
 		reqID, ok := dp.idgen.GenerateID(r)
 		if !ok {
 			// reqID が取得できなかったリクエストは対象外なので何もせず次のハンドラに投げて終わる
 			next.ServeHTTP(w, r)
 			return
 		}
-		dw, done, first := dp.Register(w, reqID)
+		// Host は r.Header に入っていないので idgen では区別されない
+		reqID = requestid.RequestID(r.Host + " " + string(reqID))
+		dw, first, err := dp.Register(r.Context(), reqID, r.Method+" "+r.Host+r.URL.RequestURI())
+		if err == errResponseTooLarge {
+			// 大き過ぎて最初から返せないので自分でバックエンドに流す
+			bundlerMetrics.Add(err.Error(), 1)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			// 詰まっているので待たせずに断る
+			bundlerMetrics.Add(err.Error(), 1)
+			dp.reject(w)
+			return
+		}
+		defer dw.leave()
 		if first {
 			// 同時リクエストの最初のリクエストが代表して dw を次のハンドラに投げる
+			// 代表のクライアントが切断しても他が待っているので、クライアントから切り離した dw.ctx で投げる
 			go func() {
-				defer dw.Done()
-				next.ServeHTTP(dw, r)
+				defer dw.cancel()
+				defer func() {
+					// 別の goroutine なので panic は net/http に拾われない。ここで止めて待っている全員のレスポンスを中断させる
+					if err := recover(); err != nil {
+						if err != http.ErrAbortHandler {
+							log.Printf("ERROR RequestBundler: panic serving %v: %v\n%s", dw.request, err, debug.Stack())
+						}
+						dw.container.abort()
+					}
+					dw.Done()
+				}()
+				next.ServeHTTP(dw, r.WithContext(dw.ctx))
 			}()
 		}
-		// 代表リクエストのレスポンスが返ってくるのを待つ
-		<-done
+		// 代表リクエストのレスポンスを書かれた端から流す（途中から来たリクエストはそれまでの分を先に書く）
+		// 自分のクライアントが切断したらレスポンスを待たずに抜ける
+		_, err = dw.container.StreamTo(r.Context(), w)
+		switch err {
+		case errResponseTooLarge:
+			// 読み始める前に MaxBytes を超えて先頭を捨てられたので自分でバックエンドに流す（まだ何も書いていない）
+			bundlerMetrics.Add(err.Error(), 1)
+			next.ServeHTTP(w, r)
+		case errSlowReader:
+			bundlerMetrics.Add(err.Error(), 1)
+			log.Printf("%v %v >MaxBytes(%v) >SlowClientTimeout(%v)", "SLOWCUT", dw.request, dp.maxBytes, dp.slowClientTimeout)
+			// ヘッダは書いてしまっているので、途中で切れたボディを正常に終わったように見せないように接続ごと切る
+			panic(http.ErrAbortHandler)
+		case errResponseAborted:
+			// 途中で切れたレスポンスを正常に終わったように見せないように接続ごと切る
+			bundlerMetrics.Add(err.Error(), 1)
+			panic(http.ErrAbortHandler)
+		}
 	})
 }
 
 // requestBundler is middleware
 type requestBundler struct {
-	idgen *requestid.RequestIDGenerator
-	dw    map[requestid.RequestID]*DuplicateWriter
-	dwM   sync.Mutex
-}
-
-// Register http.ResponseWriter, get *DuplicateWriter
-func (dp *requestBundler) Register(w http.ResponseWriter, reqID requestid.RequestID) (dw *DuplicateWriter, done <-chan struct{}, first bool) {
-	dw, first = dp.getDuplicateWriter(reqID)
-	doneRW := make(chan struct{})
-	done = doneRW
-	dw.writersM.Lock()
-	defer dw.writersM.Unlock()
-	dw.writers = append(dw.writers, &waitingWriter{w, doneRW})
-	return
+	idgen             *requestid.RequestIDGenerator
+	timeout           time.Duration
+	skipBody          bool
+	skipAuthorization bool
+	microCache        *microCache
+	maxWaiters        int
+	maxInFlight       int
+	rejectStatus      int
+	rejectBody        []byte
+	retryAfter        string
+	maxBytes          int
+	slowClientTimeout time.Duration
+	dw                map[requestid.RequestID]*DuplicateWriter
+	dwM               sync.Mutex
+	// バックエンドに流している最中のリクエスト数（dwM で保護する）
+	inFlight int
 }
 
-func (dp *requestBundler) getDuplicateWriter(reqID requestid.RequestID) (dw *DuplicateWriter, first bool) {
+// Register reqID のレスポンスを共有する *DuplicateWriter を得る。first なら呼び出し側が代表してバックエンドに流す
+// 待ち終わったら dw.leave() を呼ぶこと。MaxWaiters や MaxInFlight を超える場合はエラーを返す
+// レスポンスが MaxBytes を超えていて合流できない場合は errResponseTooLarge を返す
+// first の場合の dw.ctx は ctx の値だけ引き継いで、キャンセルは引き継がない
+func (dp *requestBundler) Register(ctx context.Context, reqID requestid.RequestID, request string) (dw *DuplicateWriter, first bool, err error) {
 	dp.dwM.Lock()
 	defer dp.dwM.Unlock()
 	dw, found := dp.dw[reqID]
 	first = !found
 	if first {
+		if 0 < dp.maxInFlight && dp.maxInFlight <= dp.inFlight {
+			return nil, false, errTooManyInFlight
+		}
 		dw = &DuplicateWriter{
-			dp:              dp,
-			reqID:           reqID,
-			container:       &ResponseContainer{statusCode: 0, header: http.Header{}, body: bytes.Buffer{}},
-			writers:         []*waitingWriter{},
-			writersM:        sync.Mutex{},
-			responseWritten: make(chan struct{}),
+			dp:        dp,
+			reqID:     reqID,
+			request:   request,
+			started:   time.Now(),
+			container: newResponseContainer(dp.maxBytes, dp.slowClientTimeout),
+			header:    http.Header{},
+			inFlight:  true,
 		}
+		dw.ctx, dw.cancel = context.WithTimeout(valueOnlyContext{ctx}, dp.timeout)
 		dp.dw[reqID] = dw
+		dp.inFlight++
+	} else if !dw.finished && 0 < dp.maxWaiters && dp.maxWaiters <= dw.waiters {
+		// 完了して MicroCache に残っているものはすぐ返せるので制限しない
+		return nil, false, errTooManyWaiters
+	}
+	if !dw.container.reserve() {
+		// MaxBytes を超えたレスポンスには最初からは合流できない
+		return nil, false, errResponseTooLarge
+	}
+	dw.waiters++
+	return dw, first, nil
+}
+
+// stopped dw がバックエンドに流し終わった（dwM をロックして呼ぶ）
+func (dp *requestBundler) stopped(dw *DuplicateWriter) {
+	if dw.inFlight {
+		dw.inFlight = false
+		dp.inFlight--
+	}
+}
+
+// reject 制限を超えたリクエストに返すレスポンス
+func (dp *requestBundler) reject(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", dp.retryAfter)
+	if len(dp.rejectBody) != 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(len(dp.rejectBody)))
+	}
+	w.WriteHeader(dp.rejectStatus)
+	w.Write(dp.rejectBody)
+}
+
+// Waiters 実行中のリクエスト毎の待っているクライアント数（多い順）
+func (dp *requestBundler) Waiters() []BundlerWaiters {
+	dp.dwM.Lock()
+	list := make([]BundlerWaiters, 0, len(dp.dw))
+	for _, dw := range dp.dw {
+		list = append(list, BundlerWaiters{
+			Request:  dw.request,
+			Waiters:  dw.waiters,
+			Started:  dw.started,
+			Finished: dw.finished,
+		})
+	}
+	dp.dwM.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Waiters != list[j].Waiters {
+			return list[i].Waiters > list[j].Waiters
+		}
+		return list[i].Started.Before(list[j].Started)
+	})
+	return list
+}
+
+// unregister dw へのリクエスト登録の受付を終了させる（dwM をロックして呼ぶ）
+func (dp *requestBundler) unregister(dw *DuplicateWriter) {
+	// 同じ reqID で新しく作られたものは消さない
+	if dp.dw[dw.reqID] == dw {
+		delete(dp.dw, dw.reqID)
 	}
-	return dw, first
 }
 
-// DuplicateWriter は複数の *http.ResponseWriter へ一つのレスポンスの内容を複製して書き込みます
+// valueOnlyContext 親の値（http.ServerContextKey など）だけ引き継いで、キャンセルやデッドラインは引き継がない
+type valueOnlyContext struct {
+	context.Context
+}
+
+func (valueOnlyContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (valueOnlyContext) Done() <-chan struct{}       { return nil }
+func (valueOnlyContext) Err() error                  { return nil }
+
+// DuplicateWriter は一つのレスポンスの内容を ResponseContainer に貯めて、待っている複数の http.ResponseWriter に流します
 type DuplicateWriter struct {
-	dp              *requestBundler
-	reqID           requestid.RequestID
-	container       *ResponseContainer
-	writers         []*waitingWriter
-	writersM        sync.Mutex
-	responseWritten chan struct{}
+	dp    *requestBundler
+	reqID requestid.RequestID
+	// 代表リクエストの "METHOD host/path?query" と開始時刻（Waiters で表示する）
+	request   string
+	started   time.Time
+	container *ResponseContainer
+	// 代表リクエストのハンドラが書き換えるヘッダ（WriteHeader の時点のものを container に渡す）
+	header      http.Header
+	wroteHeader bool
+	// WriteHeader の時点で Trailer ヘッダで宣言されていたキー
+	declaredTrailers []string
+	// 代表リクエストのコンテキスト（タイムアウトするか待っているリクエストが居なくなったらキャンセルする）
+	ctx    context.Context
+	cancel context.CancelFunc
+	// レスポンスを待っているリクエストの数（dp.dwM で保護する）
+	waiters int
+	// レスポンスが完了した（dp.dwM で保護する）
+	finished bool
+	// バックエンドに流している最中で dp.inFlight に数えている（dp.dwM で保護する）
+	inFlight bool
 }
 
 var _ http.ResponseWriter = &DuplicateWriter{}      // Verify that T implements I.
@@ -105,59 +364,373 @@ var _ http.ResponseWriter = (*DuplicateWriter)(nil) // Verify that *T implements
 
 // Header implements http.ResponseWriter
 func (dw *DuplicateWriter) Header() http.Header {
-	return dw.container.header
+	return dw.header
 }
 
 // WriteHeader implements http.ResponseWriter
 func (dw *DuplicateWriter) WriteHeader(statusCode int) {
-	dw.container.statusCode = statusCode
+	if dw.wroteHeader {
+		return
+	}
+	dw.wroteHeader = true
+	dw.declaredTrailers = declaredTrailers(dw.header)
+	dw.container.writeHeader(statusCode, dw.header.Clone())
 }
 
 // Write implements http.ResponseWriter
 func (dw *DuplicateWriter) Write(chunk []byte) (int, error) {
-	return dw.container.body.Write(chunk)
+	if !dw.wroteHeader {
+		dw.WriteHeader(http.StatusOK)
+	}
+	dw.container.write(chunk)
+	return len(chunk), nil
+}
+
+// Flush implements http.Flusher（書かれた分は既に待っている ResponseWriter 達に流れているので何もしない）
+func (dw *DuplicateWriter) Flush() {
+	if !dw.wroteHeader {
+		dw.WriteHeader(http.StatusOK)
+	}
 }
 
 // Done dw へのレスポンスが完了したら呼んでもらう
 func (dw *DuplicateWriter) Done() {
-	// dw へのリクエスト登録の受付を終了させる
+	// 何も書かれなかった場合は http.ResponseWriter と同様に 200 扱い
+	dw.WriteHeader(http.StatusOK)
+	// dw へのリクエスト登録の受付を終了させる（MicroCache に残す場合は Window の後で終了させる）
+	var kept bool
 	func() {
 		dw.dp.dwM.Lock()
 		defer dw.dp.dwM.Unlock()
-		delete(dw.dp.dw, dw.reqID)
+		dw.finished = true
+		dw.dp.stopped(dw)
+		kept = dw.dp.microCache != nil && dw.dp.microCache.keep(dw)
+		if !kept {
+			dw.dp.unregister(dw)
+		}
 	}()
-	// dw で受けたレスポンスを本来の ResponseWriter 達にコピーする
-	for _, ww := range dw.writers {
-		// ResponseWriter の相手毎に回線速度差とかあるので並列にコピって個別に開放する
-		go func(ww *waitingWriter) {
-			dw.container.WriteTo(ww.w)
-			// HundlerFunc で待たせてる処理を再開させる
-			close(ww.done)
-		}(ww)
+	// 待っている ResponseWriter 達に終わりを知らせる（本文の後に書かれたトレイラーも渡す）
+	dw.container.finish(trailerOf(dw.header, dw.declaredTrailers))
+	if kept {
+		dw.dp.microCache.expire(dw)
+	}
+}
+
+// leave レスポンスを待つのを止める。誰も待っていなくなったらバックエンドへのリクエストもキャンセルする
+func (dw *DuplicateWriter) leave() {
+	dw.dp.dwM.Lock()
+	defer dw.dp.dwM.Unlock()
+	dw.waiters--
+	if dw.waiters == 0 && !dw.finished {
+		// キャンセルしたものに後から合流させないように受付も終了させる
+		dw.dp.unregister(dw)
+		dw.dp.stopped(dw)
+		dw.cancel()
 	}
 }
 
-// ResponseContainer レスポンスの一時保管場所
+// ResponseContainer レスポンスの一時保管場所。書き込みながら複数の読み手がそれぞれのペースで読み出せる
 type ResponseContainer struct {
+	m          sync.Mutex
 	statusCode int
-	header     http.Header
-	body       bytes.Buffer
+	// WriteHeader 時点のヘッダ（以降は書き換えない）
+	header http.Header
+	// 追記のみ（読み手は書き込み済みの範囲を切り出して使う）
+	body []byte
+	// body[0] のボディ全体での位置（全員が読み終わって捨てた分）
+	base int
+	// ボディの合計がこれを超えたら読み終わった部分を捨てる（0 なら無制限）
+	maxBytes int
+	// maxBytes 以上遅れた読み手を書き込みを止めて待つ最大時間。過ぎたら打ち切る
+	slowTimeout time.Duration
+	// reserve したがまだ読み始めていない読み手の数（先頭から読むので捨てられない）
+	pending int
+	// 読んでいる途中の読み手
+	readers map[*containerReader]struct{}
+	// 完了時に渡されるトレイラー
+	trailer http.Header
+	done    bool
+	// 代表リクエストのハンドラが panic して途中で終わった
+	aborted bool
+	// 書き込みがある度に close して作り直す
+	changed chan struct{}
+	// 読み手が読み進める度に close して作り直す
+	progressed chan struct{}
+}
+
+// containerReader StreamTo の読み手毎の読んだ位置
+type containerReader struct {
+	pos int
+	// 遅れ過ぎて打ち切られた
+	cut bool
+}
+
+func newResponseContainer(maxBytes int, slowTimeout time.Duration) *ResponseContainer {
+	return &ResponseContainer{
+		maxBytes:    maxBytes,
+		slowTimeout: slowTimeout,
+		readers:     map[*containerReader]struct{}{},
+		changed:     make(chan struct{}),
+		progressed:  make(chan struct{}),
+	}
+}
+
+func (rc *ResponseContainer) writeHeader(statusCode int, header http.Header) {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	rc.statusCode = statusCode
+	rc.header = header
+	rc.notify()
+}
+
+func (rc *ResponseContainer) write(chunk []byte) {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	rc.body = append(rc.body, chunk...)
+	if rc.tooLarge() {
+		rc.trim()
+	}
+	rc.notify()
+	// maxBytes 以上遅れている読み手が追い付くまで書き込みを止める（メモリに持つ量を抑える）
+	var timeout <-chan time.Time
+	for rc.lagging() {
+		if timeout == nil {
+			timer := time.NewTimer(rc.slowTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		progressed := rc.progressed
+		rc.m.Unlock()
+		select {
+		case <-progressed:
+			rc.m.Lock()
+		case <-timeout:
+			rc.m.Lock()
+			rc.cutLagging()
+		}
+		rc.trim()
+	}
+}
+
+// tooLarge ボディが maxBytes を超えた（rc.m をロックして呼ぶ）
+func (rc *ResponseContainer) tooLarge() bool {
+	return 0 < rc.maxBytes && rc.maxBytes < rc.base+len(rc.body)
+}
+
+// trim 全員が読み終わった部分を捨てる（rc.m をロックして呼ぶ）
+func (rc *ResponseContainer) trim() {
+	if !rc.tooLarge() {
+		return
+	}
+	total := rc.base + len(rc.body)
+	// 読み始めていない読み手は先頭から読めないので最初から返せない
+	rc.pending = 0
+	min := total
+	for r := range rc.readers {
+		if r.pos < min {
+			min = r.pos
+		}
+	}
+	rc.body = rc.body[min-rc.base:]
+	rc.base = min
+}
+
+// lagging maxBytes 以上遅れている読み手が居る（rc.m をロックして呼ぶ）
+func (rc *ResponseContainer) lagging() bool {
+	if rc.maxBytes <= 0 {
+		return false
+	}
+	total := rc.base + len(rc.body)
+	for r := range rc.readers {
+		if rc.maxBytes < total-r.pos {
+			return true
+		}
+	}
+	return false
+}
+
+// cutLagging maxBytes 以上遅れている読み手を打ち切る（rc.m をロックして呼ぶ）
+func (rc *ResponseContainer) cutLagging() {
+	total := rc.base + len(rc.body)
+	for r := range rc.readers {
+		if rc.maxBytes < total-r.pos {
+			r.cut = true
+			delete(rc.readers, r)
+		}
+	}
+	rc.notify()
+}
+
+// reserve 先頭から読む読み手を予約する。既に maxBytes を超えていたら false を返す
+func (rc *ResponseContainer) reserve() bool {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	if rc.tooLarge() {
+		return false
+	}
+	rc.pending++
+	return true
+}
+
+// size 書き込まれたボディのサイズ（捨てた分も含む）
+func (rc *ResponseContainer) size() int {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	return rc.base + len(rc.body)
+}
+
+// response WriteHeader されたステータスとヘッダ（ヘッダは書き換えないこと）
+func (rc *ResponseContainer) response() (int, http.Header) {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	return rc.statusCode, rc.header
 }
 
-// WriteTo http.ResponseWriter
+// isTooLarge ボディが maxBytes を超えて全体を持っていない
+func (rc *ResponseContainer) isTooLarge() bool {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	return rc.tooLarge()
+}
+
+// abort レスポンスが途中で中断されたことにする（この後に finish を呼ぶこと）
+func (rc *ResponseContainer) abort() {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	rc.aborted = true
+}
+
+// isAborted レスポンスが途中で中断された
+func (rc *ResponseContainer) isAborted() bool {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	return rc.aborted
+}
+
+func (rc *ResponseContainer) finish(trailer http.Header) {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	rc.trailer = trailer
+	rc.done = true
+	rc.notify()
+}
+
+// notify rc.m をロックして呼ぶ
+func (rc *ResponseContainer) notify() {
+	close(rc.changed)
+	rc.changed = make(chan struct{})
+}
+
+// progress 読み手が読み進めたことを書き込みを止めている write に知らせる（rc.m をロックして呼ぶ）
+func (rc *ResponseContainer) progress() {
+	close(rc.progressed)
+	rc.progressed = make(chan struct{})
+}
+
+// WriteTo レスポンスが完了するのを待ってから w に書き込む
+// maxBytes を超えて先頭を捨てていたら何も書かずに errResponseTooLarge を返す
+// 中断されたレスポンスは何も書かずに errResponseAborted を返す
 func (rc *ResponseContainer) WriteTo(w http.ResponseWriter) (int, error) {
-	header := w.Header()
-	for k, values := range rc.header {
-		for _, v := range values {
-			header.Add(k, v)
+	for {
+		rc.m.Lock()
+		done, changed := rc.done, rc.changed
+		rc.m.Unlock()
+		if done {
+			break
+		}
+		<-changed
+	}
+	if rc.aborted {
+		return 0, errResponseAborted
+	}
+	if rc.base != 0 {
+		return 0, errResponseTooLarge
+	}
+	writeHeaderTo(w, rc.statusCode, rc.header)
+	n, err := w.Write(rc.body)
+	writeTrailer(w, rc.trailer)
+	return n, err
+}
+
+// StreamTo 書き込まれた端から w に流す。読み手毎に読んだ位置を持つので遅いクライアントは他を待たせずに後から纏めて追い付く
+// ctx がキャンセルされたら途中でも止める
+// 読み始める前に先頭を捨てられていたら何も書かずに errResponseTooLarge を返す
+// maxBytes 以上遅れたまま slowTimeout が過ぎて打ち切られたら errSlowReader を返す（ヘッダを書く前なら errResponseTooLarge）
+// レスポンスが中断されたら書いた所までで errResponseAborted を返す
+func (rc *ResponseContainer) StreamTo(ctx context.Context, w http.ResponseWriter) (int, error) {
+	reader := &containerReader{}
+	rc.m.Lock()
+	if 0 < rc.pending {
+		rc.pending--
+	}
+	if rc.base != 0 {
+		rc.m.Unlock()
+		return 0, errResponseTooLarge
+	}
+	rc.readers[reader] = struct{}{}
+	rc.m.Unlock()
+	defer func() {
+		rc.m.Lock()
+		delete(rc.readers, reader)
+		rc.progress()
+		rc.m.Unlock()
+	}()
+
+	flusher, _ := w.(http.Flusher)
+	wroteHeader := false
+	for {
+		rc.m.Lock()
+		if reader.cut {
+			rc.m.Unlock()
+			if !wroteHeader {
+				// まだ何も書いていないので先頭を捨てられたのと同じ
+				return 0, errResponseTooLarge
+			}
+			return reader.pos, errSlowReader
+		}
+		statusCode, header, chunk, done, aborted, changed := rc.statusCode, rc.header, rc.body[reader.pos-rc.base:], rc.done, rc.aborted, rc.changed
+		rc.m.Unlock()
+		if aborted {
+			return reader.pos, errResponseAborted
+		}
+		flush := false
+		if !wroteHeader && statusCode != 0 {
+			writeHeaderTo(w, statusCode, header)
+			wroteHeader = true
+			flush = true
+		}
+		if len(chunk) != 0 {
+			n, err := w.Write(chunk)
+			rc.m.Lock()
+			reader.pos += n
+			rc.progress()
+			rc.m.Unlock()
+			if err != nil {
+				return reader.pos, err
+			}
+			flush = true
+		}
+		if done {
+			writeTrailer(w, rc.trailer)
+			return reader.pos, nil
+		}
+		if flush && flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return reader.pos, ctx.Err()
 		}
 	}
-	w.WriteHeader(rc.statusCode)
-	return w.Write(rc.body.Bytes())
 }
 
-// waitingWriter make set http.ResponseWriter と終了用チャンネルをセットにする入れ物
-type waitingWriter struct {
-	w    http.ResponseWriter
-	done chan struct{}
+func writeHeaderTo(w http.ResponseWriter, statusCode int, header http.Header) {
+	h := w.Header()
+	for k, values := range header {
+		for _, v := range values {
+			h.Add(k, v)
+		}
+	}
+	w.WriteHeader(statusCode)
 }
@@ -1,10 +1,14 @@
 package middleware
 
 import (
+	"context"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -100,3 +104,373 @@ func TestHandler(t *testing.T) {
 	}
 	// log.Println("final count:", finalCount)
 }
+
+func TestRequestBundler_Streaming(t *testing.T) {
+	release := make(chan struct{})
+	var hits uint32
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(&hits, 1)
+		w.Header().Set("X-Test", "stream")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("first,"))
+		<-release
+		w.Write([]byte("second"))
+	})
+	ts := httptest.NewServer(NewRequestBundler(nil).Handle(app))
+	defer ts.Close()
+
+	// 代表リクエストのレスポンスが終わる前にステータス・ヘッダ・最初のチャンクが届く
+	readFirst := func() (*http.Response, chan string) {
+		resp, err := http.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusAccepted || resp.Header.Get("X-Test") != "stream" {
+			t.Errorf("status = %v, header = %v", resp.StatusCode, resp.Header)
+		}
+		buf := make([]byte, len("first,"))
+		if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "first," {
+			t.Errorf("first chunk = %q, %v", buf, err)
+		}
+		rest := make(chan string, 1)
+		go func() {
+			defer resp.Body.Close()
+			b, _ := io.ReadAll(resp.Body)
+			rest <- string(b)
+		}()
+		return resp, rest
+	}
+	_, rest1 := readFirst()
+	// 後から来たリクエストはそれまでの分を受け取ってから続きを待つ
+	_, rest2 := readFirst()
+	close(release)
+	for _, rest := range []chan string{rest1, rest2} {
+		if got := <-rest; got != "second" {
+			t.Errorf("rest = %q", got)
+		}
+	}
+	if hits := atomic.LoadUint32(&hits); hits != 1 {
+		t.Errorf("handler was hit %v times", hits)
+	}
+}
+
+func TestResponseContainer_SlowReader(t *testing.T) {
+	rc := newResponseContainer(0, 0)
+	rc.writeHeader(http.StatusOK, http.Header{})
+	for i := 0; i < 100; i++ {
+		rc.write([]byte("x"))
+	}
+	rc.finish(nil)
+	// 書き込みが終わった後から読んでも全体が読める
+	rec := httptest.NewRecorder()
+	if n, err := rc.StreamTo(context.Background(), rec); n != 100 || err != nil || rec.Body.Len() != 100 {
+		t.Errorf("StreamTo() = %v, %v, body %v", n, err, rec.Body.Len())
+	}
+	rec = httptest.NewRecorder()
+	if n, err := rc.WriteTo(rec); n != 100 || err != nil {
+		t.Errorf("WriteTo() = %v, %v", n, err)
+	}
+}
+
+// blockingWriter は release されるまで Write を止める
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (bw *blockingWriter) Write(b []byte) (int, error) {
+	bw.entered <- struct{}{}
+	<-bw.release
+	return bw.ResponseRecorder.Write(b)
+}
+
+func TestResponseContainer_MaxBytes(t *testing.T) {
+	rc := newResponseContainer(10, 20*time.Millisecond)
+	rc.writeHeader(http.StatusOK, http.Header{})
+	if !rc.reserve() {
+		t.Fatalf("reserve() before MaxBytes = false")
+	}
+	bw := &blockingWriter{ResponseRecorder: httptest.NewRecorder(), entered: make(chan struct{}), release: make(chan struct{})}
+	slow := make(chan error, 1)
+	go func() {
+		_, err := rc.StreamTo(context.Background(), bw)
+		slow <- err
+	}()
+	rc.write([]byte("a"))
+	<-bw.entered
+	// 読み手が MaxBytes 以上遅れたら待って、追い付かなければ打ち切って読み終わっていない部分も捨てる
+	rc.write([]byte("0123456789"))
+	rc.write([]byte("0123456789"))
+	close(bw.release)
+	if err := <-slow; err != errSlowReader {
+		t.Errorf("StreamTo() of slow reader = %v, want errSlowReader", err)
+	}
+	if rc.size() != 21 || len(rc.body) != 0 {
+		t.Errorf("size() = %v, buffered = %v", rc.size(), len(rc.body))
+	}
+	// MaxBytes を超えたら先頭から読む読み手は受け付けない
+	if rc.reserve() {
+		t.Errorf("reserve() after MaxBytes = true")
+	}
+	if _, err := rc.StreamTo(context.Background(), httptest.NewRecorder()); err != errResponseTooLarge {
+		t.Errorf("StreamTo() after trim = %v, want errResponseTooLarge", err)
+	}
+	rc.finish(nil)
+	if _, err := rc.WriteTo(httptest.NewRecorder()); err != errResponseTooLarge {
+		t.Errorf("WriteTo() after trim = %v, want errResponseTooLarge", err)
+	}
+}
+
+func TestRequestBundler_MaxBytes(t *testing.T) {
+	release := make(chan struct{})
+	var hits uint32
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddUint32(&hits, 1) == 1 {
+			w.Write([]byte("0123456789"))
+			w.Write([]byte("0123456789"))
+			w.(http.Flusher).Flush()
+			<-release
+		} else {
+			w.Write([]byte("01234567890123456789"))
+		}
+		w.Write([]byte("end"))
+	})
+	ts := httptest.NewServer(newRequestBundler(&RequestBundlerConfig{MaxBytes: 16}, nil).Handle(app))
+	defer ts.Close()
+
+	leader, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Body.Close()
+	buf := make([]byte, 20)
+	if _, err := io.ReadFull(leader.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+	// MaxBytes を超えた後に来たリクエストは纏めずに自分でバックエンドに流す
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "01234567890123456789end" || atomic.LoadUint32(&hits) != 2 {
+		t.Errorf("follower body = %q, hits = %v", body, hits)
+	}
+	close(release)
+	rest, _ := io.ReadAll(leader.Body)
+	if string(buf)+string(rest) != "01234567890123456789end" {
+		t.Errorf("leader body = %q", string(buf)+string(rest))
+	}
+
+	// 打ち切られた遅いクライアントは接続ごと切る
+	finished := make(chan struct{})
+	slowApp := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("a"))
+		w.Write([]byte("0123456789"))
+		w.Write([]byte("0123456789"))
+		close(finished)
+	})
+	h := newRequestBundler(&RequestBundlerConfig{MaxBytes: 10, SlowClientTimeout: 20 * time.Millisecond}, nil).Handle(slowApp)
+	bw := &blockingWriter{ResponseRecorder: httptest.NewRecorder(), entered: make(chan struct{}), release: make(chan struct{})}
+	aborted := make(chan interface{}, 1)
+	go func() {
+		defer func() { aborted <- recover() }()
+		h.ServeHTTP(bw, httptest.NewRequest("GET", "/", nil))
+	}()
+	<-bw.entered
+	<-finished
+	close(bw.release)
+	if v := <-aborted; v != http.ErrAbortHandler {
+		t.Errorf("slow client panic = %v, want http.ErrAbortHandler", v)
+	}
+}
+
+func TestRequestBundler_Abort(t *testing.T) {
+	// ボディの途中で接続を切るバックエンド
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.ErrorLog = log.New(io.Discard, "", 0)
+	tests := []struct {
+		name string
+		app  http.Handler
+	}{
+		{"truncated upstream", proxy},
+		{"panic", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello"))
+			panic("boom")
+		})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(NewRequestBundler(nil).Handle(tt.app))
+			ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+			defer ts.Close()
+			// 途中で切れたレスポンスは正常に終わったように見せずに接続ごと切る
+			resp, err := http.Get(ts.URL)
+			if err == nil {
+				var body []byte
+				body, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err == nil {
+					t.Errorf("truncated response %q ended without error", body)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestBundler_Cancel(t *testing.T) {
+	release := make(chan struct{})
+	backendErr := make(chan error, 1)
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+			w.Write([]byte("ok"))
+			backendErr <- nil
+		case <-r.Context().Done():
+			backendErr <- r.Context().Err()
+		}
+	})
+	h := NewRequestBundler(nil).Handle(app)
+	serve := func(ctx context.Context) chan *httptest.ResponseRecorder {
+		res := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil).WithContext(ctx))
+			res <- rec
+		}()
+		return res
+	}
+
+	// 代表のクライアントが切断しても他のクライアントにはレスポンスが返る
+	leaderCtx, leaderCancel := context.WithCancel(context.Background())
+	leader := serve(leaderCtx)
+	time.Sleep(20 * time.Millisecond)
+	follower := serve(context.Background())
+	time.Sleep(20 * time.Millisecond)
+	leaderCancel()
+	select {
+	case <-leader:
+	case <-time.After(time.Second):
+		t.Fatal("canceled leader is still waiting")
+	}
+	close(release)
+	if err := <-backendErr; err != nil {
+		t.Errorf("backend is canceled: %v", err)
+	}
+	if rec := <-follower; rec.Body.String() != "ok" {
+		t.Errorf("follower body = %q", rec.Body.String())
+	}
+
+	// 全員が切断したらバックエンドへのリクエストもキャンセルする
+	release = make(chan struct{})
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	res1 := serve(ctx1)
+	time.Sleep(20 * time.Millisecond)
+	res2 := serve(ctx2)
+	time.Sleep(20 * time.Millisecond)
+	cancel1()
+	<-res1
+	select {
+	case err := <-backendErr:
+		t.Fatalf("backend is finished while a waiter remains: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	cancel2()
+	<-res2
+	select {
+	case err := <-backendErr:
+		if err != context.Canceled {
+			t.Errorf("backend err = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("backend is not canceled")
+	}
+
+	// 新しいリクエストはキャンセルされたものに合流しない
+	res3 := serve(context.Background())
+	close(release)
+	if rec := <-res3; rec.Body.String() != "ok" {
+		t.Errorf("body after cancel = %q", rec.Body.String())
+	}
+	<-backendErr
+}
+
+func TestRequestBundler_Timeout(t *testing.T) {
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		w.WriteHeader(http.StatusGatewayTimeout)
+	})
+	h := NewRequestBundlerWithConfig(&RequestBundlerConfig{Timeout: 30 * time.Millisecond}).Handle(app)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("code = %v", rec.Code)
+	}
+}
+
+func TestRequestBundler_Limits(t *testing.T) {
+	release := make(chan struct{})
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("ok"))
+	})
+	rb := NewRequestBundlerWithConfig(&RequestBundlerConfig{
+		MaxWaiters:  2,
+		MaxInFlight: 1,
+		RetryAfter:  1500 * time.Millisecond,
+		RejectBody:  "busy",
+	}).(RequestBundler)
+	h := rb.Handle(app)
+	serve := func(url string) chan *httptest.ResponseRecorder {
+		res := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+			res <- rec
+		}()
+		return res
+	}
+	waiting := []chan *httptest.ResponseRecorder{serve("http://example.com/a")}
+	time.Sleep(20 * time.Millisecond)
+	waiting = append(waiting, serve("http://example.com/a"))
+	time.Sleep(20 * time.Millisecond)
+
+	if w := rb.Waiters(); len(w) != 1 || w[0].Waiters != 2 || w[0].Request != "GET example.com/a" {
+		t.Errorf("Waiters() = %+v", w)
+	}
+	// MaxWaiters を超えた
+	rec := <-serve("http://example.com/a")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "2" || rec.Body.String() != "busy" {
+		t.Errorf("over MaxWaiters = %v %v %q", rec.Code, rec.Header(), rec.Body.String())
+	}
+	// MaxInFlight を超えた
+	if rec := <-serve("http://example.com/b"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("over MaxInFlight = %v", rec.Code)
+	}
+
+	close(release)
+	for _, res := range waiting {
+		if rec := <-res; rec.Code != http.StatusOK {
+			t.Errorf("waiting request = %v", rec.Code)
+		}
+	}
+	if rec := <-serve("http://example.com/b"); rec.Code != http.StatusOK {
+		t.Errorf("after release = %v", rec.Code)
+	}
+	if w := rb.Waiters(); len(w) != 0 {
+		t.Errorf("Waiters() after release = %+v", w)
+	}
+}
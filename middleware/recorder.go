@@ -1,8 +1,12 @@
 package middleware
 
 import (
+	"bufio"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"strings"
 )
 
 type ResponseRecorder interface {
@@ -11,6 +15,8 @@ type ResponseRecorder interface {
 	ContentLength() int
 	AddWriteHeaderListener(func(code int, header http.Header))
 	AddWriter(io.Writer)
+	// Trailer ハンドラが書き込んだトレイラー（ハンドラが終わってから呼ぶ）
+	Trailer() http.Header
 }
 
 type responseRecorder struct {
@@ -24,10 +30,14 @@ type responseRecorder struct {
 	code       int
 	clen       int
 	listenerWH []func(code int, header http.Header)
+	// WriteHeader の時点で Trailer ヘッダで宣言されていたキー
+	declaredTrailers []string
 }
 
 var _ ResponseRecorder = (*responseRecorder)(nil)
 var _ http.ResponseWriter = (*responseRecorder)(nil)
+var _ http.Flusher = (*responseRecorder)(nil)
+var _ http.Hijacker = (*responseRecorder)(nil)
 
 func NewResponseRecorder(w http.ResponseWriter) ResponseRecorder {
 	return &responseRecorder{
@@ -58,6 +68,7 @@ func (rec *responseRecorder) WriteHeader(code int) {
 		}
 	}
 	rec.code = code
+	rec.declaredTrailers = declaredTrailers(rec.Header())
 	if rec.w != nil {
 		rec.w.WriteHeader(code)
 	}
@@ -65,6 +76,10 @@ func (rec *responseRecorder) WriteHeader(code int) {
 }
 
 func (rec *responseRecorder) Write(p []byte) (n int, err error) {
+	if rec.mw == nil {
+		// WriteHeader が呼ばれずに Write された場合は http.ResponseWriter と同様に 200 扱い
+		rec.WriteHeader(http.StatusOK)
+	}
 	n, err = rec.mw.Write(p)
 	rec.clen += n
 	return n, err
@@ -88,6 +103,92 @@ func (rec *responseRecorder) AddWriter(w io.Writer) {
 	}
 }
 
+func (rec *responseRecorder) Trailer() http.Header {
+	return trailerOf(rec.Header(), rec.declaredTrailers)
+}
+
+// declaredTrailers header の Trailer ヘッダで宣言されたキー
+func declaredTrailers(header http.Header) []string {
+	var keys []string
+	for _, v := range header.Values("Trailer") {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				keys = append(keys, http.CanonicalHeaderKey(k))
+			}
+		}
+	}
+	return keys
+}
+
+// trailerOf 本文の後に header に書き込まれたトレイラーを取り出す（宣言されたキーと http.TrailerPrefix 付きのキー）
+func trailerOf(header http.Header, declared []string) http.Header {
+	var trailer http.Header
+	add := func(k string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		if trailer == nil {
+			trailer = http.Header{}
+		}
+		trailer[http.CanonicalHeaderKey(k)] = append(trailer[http.CanonicalHeaderKey(k)], values...)
+	}
+	for _, k := range declared {
+		add(k, header[k])
+	}
+	for k, values := range header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			add(strings.TrimPrefix(k, http.TrailerPrefix), values)
+		}
+	}
+	return trailer
+}
+
+// writeTrailer 本文を書いた後で w にトレイラーを書く（宣言していないキーも送れるように http.TrailerPrefix を付ける）
+func writeTrailer(w http.ResponseWriter, trailer http.Header) {
+	if len(trailer) == 0 {
+		return
+	}
+	header := w.Header()
+	for k, values := range trailer {
+		header[http.TrailerPrefix+k] = append([]string(nil), values...)
+	}
+}
+
+// Unwrap http.ResponseController で元の http.ResponseWriter を辿れるようにする（Steeler は nil）
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.w
+}
+
+// Flush implements http.Flusher（元の http.ResponseWriter が対応していれば流す。Steeler では何もしない）
+func (rec *responseRecorder) Flush() {
+	if rec.w == nil {
+		return
+	}
+	if rec.mw == nil {
+		rec.WriteHeader(http.StatusOK)
+	}
+	_ = http.NewResponseController(rec.w).Flush()
+}
+
+// Hijack implements http.Hijacker（元の http.ResponseWriter が対応していれば乗っ取る）
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if rec.w == nil {
+		return nil, nil, http.ErrNotSupported
+	}
+	return http.NewResponseController(rec.w).Hijack()
+}
+
+// isStreamingRequest レスポンスをストリーミングで受け取ろうとしているリクエストか（SSE）
+func isStreamingRequest(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// isStreamingResponse バッファせずに流すべきレスポンスか（SSE や multipart/x-mixed-replace）
+func isStreamingResponse(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "text/event-stream" || mediaType == "multipart/x-mixed-replace"
+}
+
 type responseSteeler struct {
 	responseRecorder
 }
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestResponseRecorder_Flush(t *testing.T) {
+	w := httptest.NewRecorder()
+	rec := NewResponseRecorder(w)
+	rec.Header().Set("Content-Type", "text/event-stream")
+	rec.(http.Flusher).Flush()
+	if !w.Flushed || w.Code != http.StatusOK {
+		t.Errorf("Flushed = %v, Code = %v", w.Flushed, w.Code)
+	}
+	if rec.Code() != http.StatusOK {
+		t.Errorf("rec.Code() = %v", rec.Code())
+	}
+	// http.ResponseController で元の ResponseWriter まで辿れる
+	if err := http.NewResponseController(rec).Flush(); err != nil {
+		t.Errorf("ResponseController.Flush() = %v", err)
+	}
+	// Steeler は元が無いので何もしない
+	NewResponseSteeler().(http.Flusher).Flush()
+}
+
+func TestResponseRecorder_Hijack(t *testing.T) {
+	// httptest.ResponseRecorder は Hijack できない
+	if _, _, err := NewResponseRecorder(httptest.NewRecorder()).(http.Hijacker).Hijack(); !errors.Is(err, http.ErrNotSupported) {
+		t.Errorf("Hijack() = %v", err)
+	}
+	if _, _, err := NewResponseSteeler().(http.Hijacker).Hijack(); !errors.Is(err, http.ErrNotSupported) {
+		t.Errorf("Steeler Hijack() = %v", err)
+	}
+	// 実際のコネクションは乗っ取れる
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := NewResponseRecorder(&clientTTLWriter{ResponseWriter: w})
+		conn, buf, err := rec.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack() = %v", err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 204 No Content\r\n\r\n")
+		buf.Flush()
+	}))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("StatusCode = %v", resp.StatusCode)
+	}
+}
+
+func TestIsStreamingResponse(t *testing.T) {
+	for ct, want := range map[string]bool{
+		"text/event-stream":                     true,
+		"text/event-stream; charset=utf-8":      true,
+		"multipart/x-mixed-replace; boundary=x": true,
+		"text/html":                             false,
+		"":                                      false,
+	} {
+		if got := isStreamingResponse(http.Header{"Content-Type": {ct}}); got != want {
+			t.Errorf("isStreamingResponse(%q) = %v", ct, got)
+		}
+	}
+}
+
+func TestResponseRecorder_Trailer(t *testing.T) {
+	rec := NewResponseSteeler()
+	rec.Header().Set("Trailer", "Server-Timing, x-checksum")
+	rec.WriteHeader(http.StatusOK)
+	rec.Write([]byte("body"))
+	rec.Header().Set("Server-Timing", "app;dur=12")
+	rec.Header().Set("X-Checksum", "abc")
+	rec.Header().Set(http.TrailerPrefix+"X-Undeclared", "1")
+	want := http.Header{"Server-Timing": {"app;dur=12"}, "X-Checksum": {"abc"}, "X-Undeclared": {"1"}}
+	if got := rec.Trailer(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Trailer() = %v, want %v", got, want)
+	}
+	if got := NewResponseSteeler().Trailer(); got != nil {
+		t.Errorf("Trailer() without trailers = %v", got)
+	}
+}
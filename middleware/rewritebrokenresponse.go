@@ -1,82 +1,186 @@
 package middleware
 
 import (
+	"bufio"
 	"bytes"
-	"compress/gzip"
-	"io"
-	"io/ioutil"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 
 	"log"
-
-	"github.com/andybalholm/brotli"
+	"net"
 )
 
 func NewBrokenRewriteGuard() Middleware {
-	return &BrokenRewriteGuardHandler{}
+	return NewBrokenRewriteGuardWithConfig(nil)
+}
+
+// NewBrokenRewriteGuardWithConfig ルールを指定して BrokenRewriteGuard を作る（config が nil ならデフォルト）
+func NewBrokenRewriteGuardWithConfig(config *BrokenRewriteGuardConfig) Middleware {
+	if config == nil {
+		config = &BrokenRewriteGuardConfig{}
+	}
+	rules, err := newGuardRules(config.Rules)
+	if err != nil {
+		panic(fmt.Errorf("invalid BrokenRewriteGuardConfig: %w", err))
+	}
+	rewrite := &BrokenRewriteGuardHandler{
+		rules:            rules,
+		errorStatus:      config.ErrorStatus,
+		errorBody:        []byte(config.ErrorBody),
+		errorContentType: config.ErrorContentType,
+	}
+	if rewrite.errorStatus == 0 {
+		rewrite.errorStatus = http.StatusInternalServerError
+	}
+	if len(rewrite.errorBody) == 0 {
+		rewrite.errorBody = []byte(defaultGuardErrorBody)
+	}
+	return rewrite
 }
 
 type BrokenRewriteGuardHandler struct {
+	rules            []*guardRule
+	errorStatus      int
+	errorBody        []byte
+	errorContentType string
 }
 
 func (rewrite *BrokenRewriteGuardHandler) Handle(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		rec := NewResponseSteeler()
-		buf := bytes.NewBuffer([]byte{})
-		rec.AddWriter(buf)
-		next.ServeHTTP(rec, r)
-		code := rec.Code()
-		broken := false
-		if code == http.StatusOK {
-			if strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
-				TE := rec.Header().Get("Transfer-Encoding")
-				var reader io.Reader
-				var err error
-				switch TE {
-				case "gzip":
-					reader, err = gzip.NewReader(bytes.NewBuffer(buf.Bytes()))
-				case "br":
-					reader = brotli.NewReader(bytes.NewBuffer(buf.Bytes()))
-				default:
-					reader = bytes.NewBuffer(buf.Bytes())
-				}
-				if err != nil {
-					log.Printf("BrokenRewriteGuardHandler: %v", err)
-					broken = true
-				}
-				plain, err := ioutil.ReadAll(reader)
-				if err != nil {
-					log.Printf("BrokenRewriteGuardHandler: %v", err)
-					broken = true
-				}
-				html := string(plain)
-				if strings.Contains(html, "<html") && !strings.Contains(html, "</html>") {
-					broken = true
-					log.Printf("ERROR BrokenRewriteGuardHandler: no </html>: %v", r.URL)
-				}
-				// if strings.Contains(html, "\uFFFD") {
-				// 	broken = true
-				// 	log.Printf("ERROR BrokenRewriteGuardHandler: found \\uFFFD: %v", r.URL)
-				// }
-				// log.Printf("TE=%v plain=%v, buflen=%v, plainlen=%v, broken=%v", TE, string(plain), buf.Len(), len(plain), broken)
-				if broken {
-					code = http.StatusInternalServerError
-					reloadHTML := `<!DOCTYPE html><html><head><meta charset="utf-8"><script>setTimeout(function(){location.reload()}, 5000)</script></head><body>Server Error. Reload after 5 seconds...</body></html>\n`
-					buf.Reset()
-					buf.WriteString(reloadHTML)
-					rec.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
-					rec.Header().Set("Transfer-Encoding", "identity")
-				}
+		if isUpgradeRequest(r) {
+			// Upgrade はレスポンスを検査できないので素通しする
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &guardWriter{w: w, rewrite: rewrite, method: r.Method, path: r.URL.Path}
+		next.ServeHTTP(gw, r)
+		if !gw.buffering {
+			// 検査対象外のレスポンスは既にそのまま流してある
+			return
+		}
+		code := gw.code
+		buf := &gw.buf
+		// 本文の後にヘッダに書かれたトレイラーはヘッダとして送らないように避けておく
+		trailer := trailerOf(w.Header(), gw.declaredTrailers)
+		for k := range w.Header() {
+			if strings.HasPrefix(k, http.TrailerPrefix) {
+				w.Header().Del(k)
 			}
 		}
-		for k, values := range rec.Header() {
-			for _, v := range values {
-				w.Header().Add(k, v)
+		for _, k := range gw.declaredTrailers {
+			w.Header().Del(k)
+		}
+		var reason string
+		// HEAD やボディが空のレスポンスは展開も検査もしようがないのでそのまま返す
+		if r.Method != http.MethodHead && buf.Len() != 0 {
+			reason = gw.check(w.Header(), buf.Bytes())
+		}
+		if reason != "" {
+			log.Printf("ERROR BrokenRewriteGuardHandler: %v: %v", reason, r.URL)
+			code = rewrite.errorStatus
+			buf.Reset()
+			buf.Write(rewrite.errorBody)
+			if rewrite.errorContentType != "" {
+				w.Header().Set("Content-Type", rewrite.errorContentType)
 			}
+			w.Header().Del("Content-Encoding")
+			w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+			w.Header().Set("Transfer-Encoding", "identity")
+			w.Header().Del("Trailer")
+			trailer = nil
 		}
 		w.WriteHeader(code)
 		w.Write(buf.Bytes())
+		writeTrailer(w, trailer)
 	})
 }
+
+// check マッチしたルールでボディを検査して、壊れていたら理由を返す
+// 検査は Content-Encoding を展開したボディで行い、展開できない Content-Encoding のものは検査しない
+func (gw *guardWriter) check(header http.Header, raw []byte) string {
+	plain, err := decodeContentEncoding(header, raw)
+	if errors.Is(err, errUnsupportedContentEncoding) {
+		return ""
+	}
+	if err != nil {
+		return err.Error()
+	}
+	for _, rule := range gw.rules {
+		if reason := rule.Check(header, raw, plain); reason != "" {
+			return rule.Name + ": " + reason
+		}
+	}
+	return ""
+}
+
+// guardWriter はルールにマッチしたレスポンスだけバッファして、それ以外はそのまま w に流す
+type guardWriter struct {
+	w       http.ResponseWriter
+	rewrite *BrokenRewriteGuardHandler
+	method  string
+	path    string
+	// レスポンスにマッチしたルール
+	rules       []*guardRule
+	code        int
+	wroteHeader bool
+	buffering   bool
+	buf         bytes.Buffer
+	// WriteHeader の時点で Trailer ヘッダで宣言されていたキー
+	declaredTrailers []string
+}
+
+func (gw *guardWriter) Header() http.Header {
+	return gw.w.Header()
+}
+
+func (gw *guardWriter) WriteHeader(code int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+	gw.code = code
+	header := gw.w.Header()
+	if !isStreamingResponse(header) {
+		for _, rule := range gw.rewrite.rules {
+			if rule.Match(gw.method, gw.path, code, header) {
+				gw.rules = append(gw.rules, rule)
+			}
+		}
+	}
+	gw.buffering = len(gw.rules) != 0
+	gw.declaredTrailers = declaredTrailers(header)
+	if !gw.buffering {
+		gw.w.WriteHeader(code)
+	}
+}
+
+func (gw *guardWriter) Write(p []byte) (int, error) {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.buffering {
+		return gw.buf.Write(p)
+	}
+	return gw.w.Write(p)
+}
+
+func (gw *guardWriter) Unwrap() http.ResponseWriter {
+	return gw.w
+}
+
+// Flush バッファ中は最後まで見ないと検査できないので流さない
+func (gw *guardWriter) Flush() {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if !gw.buffering {
+		_ = http.NewResponseController(gw.w).Flush()
+	}
+}
+
+func (gw *guardWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(gw.w).Hijack()
+}
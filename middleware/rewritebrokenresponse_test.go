@@ -0,0 +1,217 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBrokenRewriteGuard(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		code        int
+		body        string
+		wantCode    int
+		wantBroken  bool
+	}{
+		{"complete html", "text/html; charset=utf-8", 200, "<html><body>ok</body></html>", 200, false},
+		{"broken html", "text/html", 200, "<html><body>trunc", 500, true},
+		{"error html", "text/html", 404, "<html><body>trunc", 404, false},
+		{"json", "application/json", 200, `{"a":`, 200, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.code)
+				w.Write([]byte(tt.body))
+			})
+			rec := httptest.NewRecorder()
+			NewBrokenRewriteGuard().Handle(app).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			if rec.Code != tt.wantCode {
+				t.Errorf("code = %v, want %v", rec.Code, tt.wantCode)
+			}
+			if broken := strings.Contains(rec.Body.String(), "Reload after 5 seconds"); broken != tt.wantBroken {
+				t.Errorf("broken = %v, body = %q", broken, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestBrokenRewriteGuard_ContentEncoding(t *testing.T) {
+	complete := []byte("<html><body>ok</body></html>")
+	truncated := []byte("<html><body>trunc")
+	tests := []struct {
+		name       string
+		encoding   string
+		body       []byte
+		wantBroken bool
+	}{
+		{"gzip", "gzip", encodeForTest(t, "gzip", complete), false},
+		{"broken gzip html", "gzip", encodeForTest(t, "gzip", truncated), true},
+		{"deflate", "deflate", encodeForTest(t, "deflate", complete), false},
+		{"br", "br", encodeForTest(t, "br", complete), false},
+		{"broken br html", "br", encodeForTest(t, "br", truncated), true},
+		{"stacked", "gzip, br", encodeForTest(t, "br", encodeForTest(t, "gzip", complete)), false},
+		{"truncated gzip", "gzip", encodeForTest(t, "gzip", complete)[:20], true},
+		{"not compressed", "gzip", complete, true},
+		// 展開できない Content-Encoding は検査せずにそのまま通す
+		{"zstd", "zstd", truncated, false},
+		{"compress", "compress", truncated, false},
+		{"gzip bomb", "gzip", encodeForTest(t, "gzip", bytes.Repeat([]byte(" "), minDecodeLimit*2)), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("Content-Encoding", tt.encoding)
+				w.Write(tt.body)
+			})
+			rec := httptest.NewRecorder()
+			NewBrokenRewriteGuard().Handle(app).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			if tt.wantBroken {
+				if rec.Code != 500 || rec.Header().Get("Content-Encoding") != "" {
+					t.Errorf("code = %v, Content-Encoding = %q", rec.Code, rec.Header().Get("Content-Encoding"))
+				}
+				return
+			}
+			// 問題が無ければ圧縮されたままのバイト列を返す
+			if rec.Code != 200 || !bytes.Equal(rec.Body.Bytes(), tt.body) || rec.Header().Get("Content-Encoding") != tt.encoding {
+				t.Errorf("code = %v, body = %q, Content-Encoding = %q", rec.Code, rec.Body.Bytes(), rec.Header().Get("Content-Encoding"))
+			}
+		})
+	}
+	// HEAD やボディが空のレスポンスは展開せずにそのまま返す
+	for _, method := range []string{"HEAD", "GET"} {
+		t.Run("empty "+method, func(t *testing.T) {
+			app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Header().Set("Content-Length", "42")
+				w.WriteHeader(200)
+			})
+			rec := httptest.NewRecorder()
+			NewBrokenRewriteGuard().Handle(app).ServeHTTP(rec, httptest.NewRequest(method, "/", nil))
+			if rec.Code != 200 || rec.Body.Len() != 0 || rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("Content-Length") != "42" {
+				t.Errorf("code = %v, body = %q, header = %v", rec.Code, rec.Body.Bytes(), rec.Header())
+			}
+		})
+	}
+
+}
+
+func TestBrokenRewriteGuard_Rules(t *testing.T) {
+	config := &BrokenRewriteGuardConfig{
+		Rules: []GuardRule{
+			{Name: "api", Path: "/api/*", ContentType: "application/json*", ValidJSON: true, ContentLength: true},
+			{Name: "text", ContentType: "text/plain*", Codes: []int{200, 404}, MinBytes: 3, MustMatch: "^ok", MustNotMatch: "(?i)fatal", ValidUTF8: true},
+		},
+		ErrorStatus: 503,
+	}
+	tests := []struct {
+		name          string
+		path          string
+		contentType   string
+		code          int
+		contentLength string
+		body          string
+		wantCode      int
+	}{
+		{"valid json", "/api/a", "application/json", 200, "", `{"a":1}`, 200},
+		{"invalid json", "/api/a", "application/json", 200, "", `{"a":`, 503},
+		{"json out of path", "/other", "application/json", 200, "", `{"a":`, 200},
+		{"content-length mismatch", "/api/a", "application/json", 200, "100", `{"a":1}`, 503},
+		{"content-length match", "/api/a", "application/json", 200, "7", `{"a":1}`, 200},
+		{"text ok", "/", "text/plain", 200, "", "ok!!", 200},
+		{"text 404", "/", "text/plain", 404, "", "ok", 503},
+		{"text 500 not checked", "/", "text/plain", 500, "", "", 500},
+		{"text not match", "/", "text/plain", 200, "", "ng!!", 503},
+		{"text must not match", "/", "text/plain", 200, "", "ok Fatal error", 503},
+		{"text invalid utf8", "/", "text/plain", 200, "", "ok\xff", 503},
+		{"text replacement char", "/", "text/plain", 200, "", "ok\uFFFD", 503},
+		{"html not checked", "/", "text/html", 200, "", "<html>", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				if tt.contentLength != "" {
+					w.Header().Set("Content-Length", tt.contentLength)
+				}
+				w.WriteHeader(tt.code)
+				w.Write([]byte(tt.body))
+			})
+			rec := httptest.NewRecorder()
+			NewBrokenRewriteGuardWithConfig(config).Handle(app).ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+			if rec.Code != tt.wantCode {
+				t.Errorf("code = %v, want %v, body = %q", rec.Code, tt.wantCode, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestBrokenRewriteGuard_NoBody(t *testing.T) {
+	config := &BrokenRewriteGuardConfig{
+		Rules: []GuardRule{
+			{Name: "api", Path: "/api/*", Codes: []int{200, 204, 304}, ValidJSON: true, ContentLength: true, MinBytes: 2, MustMatch: "^{"},
+		},
+	}
+	tests := []struct {
+		name   string
+		method string
+		code   int
+	}{
+		{"head", "HEAD", 200},
+		{"no content", "GET", 204},
+		{"not modified", "GET", 304},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Length", "11")
+				w.WriteHeader(tt.code)
+			})
+			var buffering bool
+			rec := httptest.NewRecorder()
+			NewBrokenRewriteGuardWithConfig(config).Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				app.ServeHTTP(w, r)
+				buffering = w.(*guardWriter).buffering
+			})).ServeHTTP(rec, httptest.NewRequest(tt.method, "/api/a", nil))
+			if buffering {
+				t.Errorf("%v %v response is buffered", tt.method, tt.code)
+			}
+			if rec.Code != tt.code || rec.Header().Get("Content-Length") != "11" {
+				t.Errorf("code = %v, want %v, header = %v", rec.Code, tt.code, rec.Header())
+			}
+		})
+	}
+}
+
+func TestBrokenRewriteGuard_Streaming(t *testing.T) {
+	next := make(chan struct{})
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		<-next
+		w.Write([]byte("data: 2\n\n"))
+	})
+	ts := httptest.NewServer(NewBrokenRewriteGuard().Handle(app))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// ハンドラが終わる前に最初のイベントが届く
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "data: 1\n" {
+		t.Errorf("first line = %q, %v", line, err)
+	}
+	close(next)
+}
@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UpgradeConfig Upgrade（WebSocket など）で乗っ取られたコネクションの制限
+type UpgradeConfig struct {
+	// 送受信が無いまま経過したら切断する時間（0 なら無制限）
+	IdleTimeout time.Duration
+	// 接続してから切断するまでの最大時間（0 なら無制限）
+	MaxDuration time.Duration
+}
+
+// isUpgradeRequest Connection: Upgrade のリクエストか（バッファするミドルウェアは素通しする）
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NewUpgradeLimiter Upgrade されたコネクションに IdleTimeout と MaxDuration を適用するミドルウェア
+// 後ろのハンドラ（httputil.ReverseProxy）が Hijack したコネクションを包んで制限する
+func NewUpgradeLimiter(config *UpgradeConfig) Middleware {
+	return MiddlewareFunc(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isUpgradeRequest(r) || (config.IdleTimeout <= 0 && config.MaxDuration <= 0) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(&upgradeWriter{ResponseWriter: w, config: config, r: r}, r)
+		})
+	})
+}
+
+type upgradeWriter struct {
+	http.ResponseWriter
+	config *UpgradeConfig
+	r      *http.Request
+}
+
+func (uw *upgradeWriter) Unwrap() http.ResponseWriter {
+	return uw.ResponseWriter
+}
+
+func (uw *upgradeWriter) Flush() {
+	_ = http.NewResponseController(uw.ResponseWriter).Flush()
+}
+
+func (uw *upgradeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(uw.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	uc := newUpgradedConn(conn, uw.config, uw.r.Header.Get("Upgrade")+" "+uw.r.Host+uw.r.URL.RequestURI())
+	// 読み込み済みのバッファを先に読ませてから uc 経由で読み書きさせる
+	buffered := io.LimitReader(brw.Reader, int64(brw.Reader.Buffered()))
+	return uc, bufio.NewReadWriter(bufio.NewReader(io.MultiReader(buffered, uc)), bufio.NewWriter(uc)), nil
+}
+
+// upgradedConn は送受信の度に最終時刻を記録して、IdleTimeout か MaxDuration を過ぎたら切断する
+type upgradedConn struct {
+	net.Conn
+	desc    string
+	started time.Time
+	// 最後に送受信した時刻（UnixNano）
+	last   int64
+	idle   *time.Timer
+	max    *time.Timer
+	once   sync.Once
+	reason atomic.Value
+}
+
+func newUpgradedConn(conn net.Conn, config *UpgradeConfig, desc string) *upgradedConn {
+	uc := &upgradedConn{Conn: conn, desc: desc, started: time.Now()}
+	uc.touch()
+	if 0 < config.IdleTimeout {
+		var check func()
+		check = func() {
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&uc.last)))
+			if idle < config.IdleTimeout {
+				uc.idle.Reset(config.IdleTimeout - idle)
+				return
+			}
+			uc.closeWith("IdleTimeout")
+		}
+		uc.idle = time.AfterFunc(config.IdleTimeout, check)
+	}
+	if 0 < config.MaxDuration {
+		uc.max = time.AfterFunc(config.MaxDuration, func() { uc.closeWith("MaxDuration") })
+	}
+	log.Printf("%v %v", "UPGRADE", uc.desc)
+	return uc
+}
+
+func (uc *upgradedConn) touch() {
+	atomic.StoreInt64(&uc.last, time.Now().UnixNano())
+}
+
+func (uc *upgradedConn) Read(p []byte) (int, error) {
+	n, err := uc.Conn.Read(p)
+	if 0 < n {
+		uc.touch()
+	}
+	return n, err
+}
+
+func (uc *upgradedConn) Write(p []byte) (int, error) {
+	n, err := uc.Conn.Write(p)
+	if 0 < n {
+		uc.touch()
+	}
+	return n, err
+}
+
+func (uc *upgradedConn) closeWith(reason string) {
+	uc.reason.Store(reason)
+	uc.Close()
+}
+
+func (uc *upgradedConn) Close() error {
+	err := uc.Conn.Close()
+	uc.once.Do(func() {
+		if uc.idle != nil {
+			uc.idle.Stop()
+		}
+		if uc.max != nil {
+			uc.max.Stop()
+		}
+		reason, _ := uc.reason.Load().(string)
+		log.Printf("%v %v %10s %v", "UPCLOSE", uc.desc, time.Since(uc.started).Truncate(time.Millisecond), reason)
+	})
+	return err
+}
@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// echoUpgradeBackend は Upgrade: echo で受けた行をそのまま返す
+func echoUpgradeBackend(t *testing.T) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUpgradeRequest(r) {
+			w.Write([]byte("not upgraded"))
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("backend Hijack() = %v", err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			brw.WriteString(line)
+			brw.Flush()
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func dialUpgrade(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("StatusCode = %v", resp.StatusCode)
+	}
+	return conn, br
+}
+
+func TestUpgradePassthrough(t *testing.T) {
+	fm := newFakeMemcached(t)
+	backendURL, _ := url.Parse(echoUpgradeBackend(t).URL)
+	proxy := httputil.NewSingleHostReverseProxy(backendURL)
+	handler := MultipleHandler(proxy,
+		NewUpgradeLimiter(&UpgradeConfig{IdleTimeout: 100 * time.Millisecond, MaxDuration: time.Second}),
+		NewDumpHandler(t.TempDir()),
+		NewRequestBundler(nil),
+		NewCacheHandler(&CacheConfig{MemcachedServers: []string{fm.Addr()}, SoftTTL: time.Minute, HardTTL: time.Hour, NewResponseWaitLimit: time.Second}),
+		NewBrokenRewriteGuard(),
+	)
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	conn, br := dialUpgrade(t, ts.Listener.Addr().String())
+	for _, msg := range []string{"ping\n", "pong\n"} {
+		io.WriteString(conn, msg)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if got, err := br.ReadString('\n'); got != msg || err != nil {
+			t.Fatalf("echo = %q, %v", got, err)
+		}
+	}
+	if fm.Count("get") != 0 {
+		t.Errorf("upgrade request looked up the cache")
+	}
+
+	// IdleTimeout を過ぎたら切断される
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	start := time.Now()
+	if _, err := br.ReadString('\n'); err == nil {
+		t.Errorf("connection is not closed after IdleTimeout")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("closed after %v", elapsed)
+	}
+}
+
+func TestUpgradeLimiter_MaxDuration(t *testing.T) {
+	backendURL, _ := url.Parse(echoUpgradeBackend(t).URL)
+	proxy := httputil.NewSingleHostReverseProxy(backendURL)
+	ts := httptest.NewServer(NewUpgradeLimiter(&UpgradeConfig{MaxDuration: 150 * time.Millisecond}).Handle(proxy))
+	defer ts.Close()
+
+	conn, br := dialUpgrade(t, ts.Listener.Addr().String())
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	start := time.Now()
+	// 送受信していても MaxDuration で切断される
+	for i := 0; i < 20; i++ {
+		io.WriteString(conn, "ping\n")
+		if _, err := br.ReadString('\n'); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || 400*time.Millisecond < elapsed {
+		t.Errorf("closed after %v, want about MaxDuration", elapsed)
+	}
+}
+
+func TestIsUpgradeRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	if isUpgradeRequest(r) {
+		t.Errorf("plain request is upgrade")
+	}
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	if !isUpgradeRequest(r) {
+		t.Errorf("upgrade request is not detected")
+	}
+	r.Header.Del("Upgrade")
+	if isUpgradeRequest(r) {
+		t.Errorf("request without Upgrade header is upgrade")
+	}
+}
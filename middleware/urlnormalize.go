@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// KeyNormalizeConfig キャッシュキーにする URL の正規化の設定
+// ホスト名の小文字化、デフォルトポートの除去、パーセントエンコーディングの統一、ドットセグメントの除去、クエリパラメータの並べ替えをする
+type KeyNormalizeConfig struct {
+	// キーから除去するクエリパラメータ名（ワイルドカード。例: "utm_*", "fbclid"）
+	DropQuery []string
+	// DropQuery をバックエンドへのリクエストからも除去する
+	DropQueryUpstream bool
+}
+
+// urlNormalizer は同じリソースを指す URL が同じキーになるように正規化する
+type urlNormalizer struct {
+	dropQuery         Pattern
+	dropQueryUpstream bool
+}
+
+func newURLNormalizer(config *KeyNormalizeConfig) *urlNormalizer {
+	un := &urlNormalizer{
+		dropQueryUpstream: config.DropQueryUpstream,
+	}
+	if len(config.DropQuery) != 0 {
+		un.dropQuery = NewWildCardsOr(config.DropQuery...)
+	}
+	return un
+}
+
+// Host ホスト名を小文字にしてデフォルトポートを除去する
+func (un *urlNormalizer) Host(host string, tls bool) string {
+	host = strings.ToLower(host)
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return strings.TrimSuffix(host, ".")
+	}
+	h = strings.TrimSuffix(h, ".")
+	if (!tls && port == "80") || (tls && port == "443") || port == "" {
+		if strings.Contains(h, ":") {
+			// IPv6
+			return "[" + h + "]"
+		}
+		return h
+	}
+	return net.JoinHostPort(h, port)
+}
+
+// Path パーセントエンコーディングを統一してドットセグメントを除去する
+func (un *urlNormalizer) Path(u *url.URL) string {
+	segs := strings.Split(u.EscapedPath(), "/")
+	out := make([]string, 0, len(segs))
+	trailingSlash := false
+	for i, seg := range segs {
+		if i == 0 {
+			// 先頭の "/" の前
+			continue
+		}
+		last := i == len(segs)-1
+		switch seg {
+		case ".":
+			trailingSlash = last
+			continue
+		case "..":
+			if len(out) != 0 {
+				out = out[:len(out)-1]
+			}
+			trailingSlash = last
+			continue
+		}
+		trailingSlash = false
+		if s, err := url.PathUnescape(seg); err == nil {
+			seg = url.PathEscape(s)
+		}
+		out = append(out, seg)
+	}
+	p := "/" + strings.Join(out, "/")
+	if trailingSlash && p != "/" {
+		p += "/"
+	}
+	return p
+}
+
+// Query DropQuery に該当するパラメータを除去してパラメータ名でソートする
+// 解釈できないパラメータ（不正な % エスケープや ; 区切り）があればそのまま返す
+// ParseQuery はそれらを読み飛ばすので、正規化すると違うクエリが同じキーになってしまう
+func (un *urlNormalizer) Query(rawQuery string) string {
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery
+	}
+	un.drop(q)
+	return q.Encode()
+}
+
+// UpstreamQuery バックエンドに送るクエリ。DropQueryUpstream なら DropQuery に該当するパラメータを除去する（並び順は変えない）
+func (un *urlNormalizer) UpstreamQuery(rawQuery string) (string, bool) {
+	if !un.dropQueryUpstream || un.dropQuery == nil || rawQuery == "" {
+		return rawQuery, false
+	}
+	var kept []string
+	changed := false
+	for _, kv := range strings.Split(rawQuery, "&") {
+		k := kv
+		if i := strings.IndexByte(kv, '='); i != -1 {
+			k = kv[:i]
+		}
+		if name, err := url.QueryUnescape(k); err == nil && un.dropQuery.Match(name) {
+			changed = true
+			continue
+		}
+		kept = append(kept, kv)
+	}
+	return strings.Join(kept, "&"), changed
+}
+
+func (un *urlNormalizer) drop(q url.Values) {
+	if un.dropQuery == nil {
+		return
+	}
+	for k := range q {
+		if un.dropQuery.Match(k) {
+			q.Del(k)
+		}
+	}
+}
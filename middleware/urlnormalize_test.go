@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestURLNormalizer_Host(t *testing.T) {
+	un := newURLNormalizer(&KeyNormalizeConfig{})
+	tests := []struct {
+		host string
+		tls  bool
+		want string
+	}{
+		{"Example.COM", false, "example.com"},
+		{"example.com:80", false, "example.com"},
+		{"example.com:443", true, "example.com"},
+		{"example.com:443", false, "example.com:443"},
+		{"example.com:8080", false, "example.com:8080"},
+		{"example.com.", false, "example.com"},
+		{"[::1]:80", false, "[::1]"},
+		{"[::1]:8080", false, "[::1]:8080"},
+	}
+	for _, tt := range tests {
+		if got := un.Host(tt.host, tt.tls); got != tt.want {
+			t.Errorf("Host(%v, %v) = %v, want %v", tt.host, tt.tls, got, tt.want)
+		}
+	}
+}
+
+func TestURLNormalizer_Path(t *testing.T) {
+	un := newURLNormalizer(&KeyNormalizeConfig{})
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", "/"},
+		{"", "/"},
+		{"/a/b", "/a/b"},
+		{"/a/./b", "/a/b"},
+		{"/a/../b", "/b"},
+		{"/../../a", "/a"},
+		{"/a/b/..", "/a/"},
+		{"/a/b/.", "/a/b/"},
+		{"/a/", "/a/"},
+		{"/%7Euser", "/~user"},
+		{"/%e3%81%82", "/%E3%81%82"},
+		{"/a%2Fb", "/a%2Fb"},
+		{"/a b", "/a%20b"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := un.Path(u); got != tt.want {
+			t.Errorf("Path(%v) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestURLNormalizer_Query(t *testing.T) {
+	un := newURLNormalizer(&KeyNormalizeConfig{DropQuery: []string{"utm_*", "fbclid"}, DropQueryUpstream: true})
+	tests := []struct {
+		query        string
+		want         string
+		wantUpstream string
+	}{
+		{"", "", ""},
+		{"b=1&a=2", "a=2&b=1", "b=1&a=2"},
+		{"a=2&b=1", "a=2&b=1", "a=2&b=1"},
+		{"a=%7E&a=1", "a=~&a=1", "a=%7E&a=1"},
+		{"utm_source=x&b=1&fbclid=y&utm_medium=z", "b=1", "b=1"},
+		{"q=a+b", "q=a+b", "q=a+b"},
+		// 解釈できないクエリは正規化しない（別のクエリと同じキーにならないように）
+		{"b=1&a=%zz", "b=1&a=%zz", "b=1&a=%zz"},
+		{"b=1&evil=%zz&utm_source=x", "b=1&evil=%zz&utm_source=x", "b=1&evil=%zz"},
+		{"b=1;a=2", "b=1;a=2", "b=1;a=2"},
+	}
+	if un.Query("b=1&a=%zz") == un.Query("b=1") {
+		t.Errorf("malformed query has the same key as %q", un.Query("b=1"))
+	}
+	for _, tt := range tests {
+		if got := un.Query(tt.query); got != tt.want {
+			t.Errorf("Query(%v) = %v, want %v", tt.query, got, tt.want)
+		}
+		if got, _ := un.UpstreamQuery(tt.query); got != tt.wantUpstream {
+			t.Errorf("UpstreamQuery(%v) = %v, want %v", tt.query, got, tt.wantUpstream)
+		}
+	}
+}
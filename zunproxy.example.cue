@@ -7,6 +7,57 @@ Backend: "http://backend:8080"
 #DumpDir: "/tmp/zunproxy-dump/%Y/%m/%d/%H/%M"
 
 Bundler: false
+// Bundler の設定。Timeout は代表リクエストがバックエンドを待つ最大時間（クライアントが全員切断したらその時点でキャンセルする）
+// Methods/Paths/ExceptPaths で纏める対象を、Headers/QueryAccept/QueryDrop/Cookies で同じリクエストとみなす条件を指定する（ワイルドカードは末尾の * のみ）
+// Headers/Cookies は省略すると全てのヘッダ・クッキーで区別し、指定したときだけそれに絞る
+// BundlerConfig: {
+//     Timeout: time.ParseDuration("30s")
+//     Methods: ["GET", "HEAD"]
+//     ExceptPaths: ["/admin/*"]
+//     Headers: ["Origin", "Accept-Encoding", "X-Device"]
+//     QueryDrop: ["utm_*", "gclid", "fbclid"]
+//     Cookies: ["lang"]
+//     SkipBody: true
+//     SkipAuthorization: true
+//     // 完了したレスポンスを Window の間残して、直後に来た同じリクエストにも返す
+//     MicroCache: {
+//         Window: time.ParseDuration("500ms")
+//         MaxBytes: 1048576
+//         TotalBytes: 67108864
+//     }
+//     // 一つのリクエストを待てるクライアント数と同時にバックエンドに流す数の上限。超えたら RejectStatus と Retry-After を返す
+//     MaxWaiters: 1000
+//     MaxInFlight: 200
+//     RejectStatus: 503
+//     RetryAfter: time.ParseDuration("2s")
+//     RejectBody: "Service Temporarily Unavailable"
+//     // 共有するレスポンスをメモリに持つ最大サイズ。超えたら後から来たリクエストは纏めず、MaxBytes 以上遅れたクライアントは SlowClientTimeout で打ち切る
+//     MaxBytes: 8388608
+//     SlowClientTimeout: time.ParseDuration("5s")
+// }
+
+// Upgrade（WebSocket など）したコネクションを無通信 IdleTimeout か接続から MaxDuration で切断する
+// Upgrade: {
+//     IdleTimeout: time.ParseDuration("5m")
+//     MaxDuration: time.ParseDuration("24h")
+// }
+
+// 壊れたレスポンス（書き換え途中で切れた HTML など）をエラーに差し替えるルール。省略時は text/html の 200 で <html があって </html> が無いものだけ
+// Path/ContentType/Codes にマッチした全てのルールで検査する（Codes の省略時は 200）
+// Guard: {
+//     Rules: [
+//         {Name: "html", ContentType: "text/html*", StartMarker: "<html", EndMarker: "</html>", ValidUTF8: true},
+//         {Name: "api", Path: "/api/*", ContentType: "application/json*", ValidJSON: true, ContentLength: true},
+//         {Name: "top", Path: "/", ContentType: "text/html*", MinBytes: 10000, MustNotMatch: "(?i)fatal error"},
+//     ]
+//     ErrorStatus: 503
+// }
+
+// 管理用 API（固定レスポンスやロールバック、/debug/vars と /debug/pprof）を待ち受けるポート
+#AdminPort: 3001
+// 管理用 API は 127.0.0.1 で待ち受ける。他のアドレスで待ち受ける場合は Authorization: Bearer で要求するトークンが必須
+#AdminAddr: "10.0.0.1"
+#AdminToken: "change-me"
 
 Cache: {
     // memcached サーバリスト
@@ -24,6 +75,19 @@ Cache: {
     // キャッシュ更新時にバックエンドからの最新レスポンスを待つ時間。バックエンドのレスポンスがこれより遅い場合は古いキャッシュを返す。
     NewResponseWaitLimit: time.ParseDuration("20ms")
 
+    // キャッシュ更新でバックエンドを待つ最大時間。超えたら更新を諦めてキャッシュはそのまま使う（新規のキャッシュ作成には使わない）
+    RefreshTimeout: time.ParseDuration("30s")
+
+    // 同時に実行するバックグラウンドでのキャッシュ更新の最大数。超えた分は更新せずに古いキャッシュを返す
+    MaxRefreshes: 100
+
+    // NewResponseWaitLimit の代わりにキー毎の直近の応答時間の中央値(p50)だけ待つ。Max より遅いキーは待たずに古いキャッシュを返す
+    // AdaptiveWait: {
+    //     Min: time.ParseDuration("5ms")
+    //     Max: time.ParseDuration("200ms")
+    //     Samples: 10
+    // }
+
     // バックエンドのレスポンスコードに応じたTTL
     ErrorTTL: "404": time.ParseDuration("4s")
     ErrorTTL: "413": time.ParseDuration("0s")
@@ -31,5 +95,92 @@ Cache: {
 
     // キャッシュする最大レスポンスサイズ(ヘッダやエンコードを含め1MBを超えるとmemcachedに保存できない等のケース対応)
     BytesLimit: 700K
+
+    // キャッシュキーにする URL を正規化する（ホスト名の小文字化、デフォルトポート除去、パーセントエンコーディングの統一、ドットセグメント除去、クエリの並べ替え）
+    // KeyNormalize: {
+    //     // キーから除去するクエリパラメータ
+    //     DropQuery: ["utm_*", "fbclid", "gclid"]
+    //     // バックエンドへのリクエストからも除去する
+    //     DropQueryUpstream: false
+    // }
+
+    // 参照系の POST リクエストをボディ込みでキャッシュするパス（JSON やフォームは正規化したボディのハッシュをキーに含める）
+    // PostCache: {
+    //     Paths: ["/graphql", "/api/search"]
+    //     BodyLimit: 64K
+    // }
+
+    // クライアントに返す Cache-Control/Expires/Age を zunproxy 自身のキャッシュ期間とは別にパス毎に書き換える（上から順に最初にマッチしたもの）
+    // バックエンドが private や no-store を指定したレスポンスと 4xx/5xx は書き換えない
+    // ClientTTL: [
+    //     {Path: "/static/*", MaxAge: time.ParseDuration("24h"), Directives: "public"},
+    //     {Path: "*", MaxAge: time.ParseDuration("30s")},
+    // ]
+
+    // バックエンドの障害中(5xx/タイムアウト)は最後の正常なキャッシュを上書きせず、障害開始から MaxOutage までは HardTTL を過ぎても残す
+    // 状況はログ(OUTAGE/GRACE/RECOVER)と管理用ポートの /debug/vars の zunproxy_cache で確認できる
+    // Grace: {
+    //     MaxOutage: time.ParseDuration("72h")
+    //     RetryInterval: time.ParseDuration("10s")
+    // }
+
+    // zunproxy cache pin で固定したレスポンスを memcached から読み直す間隔
+    // PinReloadInterval: time.ParseDuration("5s")
+
+    // 過去のレスポンスを保持して zunproxy cache rollback で戻せるようにする
+    // Versions: {
+    //     // 保持する世代数（デフォルトは 3、最大 20）
+    //     Keep: 3
+    //     TTL: time.ParseDuration("72h")
+    //     Tags: news: ["/news/*"]
+    // }
+
+    // バックエンドが 200 で返した壊れたレスポンスでキャッシュを上書きしない（リクエスト元にはそのまま返す）
+    // Anomaly: {
+    //     // 前回より 80% 以上小さくなったら怪しい
+    //     MaxShrinkPercent: 80
+    //     // Content-Type が変わったら怪しい
+    //     ContentTypeChange: true
+    //     // 含まれているべき文字列
+    //     RequiredMarkers: [
+    //         {ContentType: "text/html*", Marker: "</html>"},
+    //     ]
+    //     // 同じ怪しいボディが 3 回続いたら正常な変更とみなす
+    //     AcceptAfter: 3
+    // }
+
+    // ボディをハッシュをキーにした別アイテムに保存する（ボディが変わらない更新はメタ情報だけ書き換え、同じボディは URL を跨いで共有する）
+    BodyDedup: false
+
+    // キャッシュを作ったリクエストを追記していくファイル（zunproxy cache export -index で使う）
+    // 同じリクエストはプロセス毎に一度だけ追記する。大きくなったら truncate -s 0 でその場で切り詰める（mv で退避すると退避した方に書き続ける）
+    // KeyIndexFile: "/var/lib/zunproxy/keys.txt"
+
+    // Window の間に MinHits 回リクエストされたものだけキャッシュに保存する（クローラ等の一度きりのリクエストで有用なキャッシュが追い出されるのを防ぐ）
+    // Admission: {
+    //     MinHits: 2
+    //     Window: time.ParseDuration("10m")
+    //     Routes: [
+    //         {Path: "/search*", MinHits: 5},
+    //         {Path: "/static/*", MinHits: 1},
+    //     ]
+    // }
+
+    // memcached に保存する値を AES-GCM で暗号化する。KeyID の鍵で暗号化し、値に記録された鍵IDで復号する（鍵のローテーション用に古い鍵も残しておく）
+    // Encryption: {
+    //     KeyID: "2023-01"
+    //     Keys: "2022-12": "base64 encoded 16/24/32 bytes key"
+    //     KeyFiles: "2023-01": "/etc/zunproxy/cache-2023-01.key"
+    // }
+
+    // SoftTTL やキーの正規化を変える前に、別の設定で評価だけしてヒット率とキーの種類数を本番と比べる
+    // Shadow: {
+    //     Cache: {
+    //         SoftTTL: time.ParseDuration("5m")
+    //         HardTTL: time.ParseDuration("24h")
+    //         KeyNormalize: DropQuery: ["utm_*", "fbclid"]
+    //     }
+    //     Window: time.ParseDuration("1h")
+    // }
 }
 